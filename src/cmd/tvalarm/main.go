@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os/exec"
 	"time"
@@ -36,15 +38,13 @@ func getState(data *tv.Data, now time.Time) *state {
 }
 
 func main() {
+	flag.StringVar(&db.DefaultClient.Url, "tvctl", db.DefaultClient.Url, "URL of tvctl")
+	flag.Parse()
+
+	ctx := context.Background()
+
 	notificationQueue := make(chan struct{})
-	go func() {
-		defer close(notificationQueue)
-		for {
-			err := db.ListenData(notificationQueue)
-			log.Printf("Listen failed: %v", err)
-			time.Sleep(30 * time.Second)
-		}
-	}()
+	go db.ListenData(ctx, notificationQueue)
 
 	data := &tv.Data{}
 
@@ -71,7 +71,7 @@ func main() {
 		case <-notificationQueue:
 			timer.Stop()
 			log.Print("Fetching data...")
-			newData, err := db.FetchData()
+			newData, err := db.FetchData(ctx)
 			if err != nil {
 				log.Printf("fetchData failed: %v", err)
 				break
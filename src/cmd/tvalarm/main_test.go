@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"zng.jp/tv"
+	"zng.jp/tv/db/dbtest"
+)
+
+func TestGetStateFromServer(t *testing.T) {
+	server, err := dbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx := context.Background()
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	data.InsertStreamInfo("00101", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 101, Title: "NHK BS1", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "News"},
+			{Start: start.Add(time.Hour), Duration: time.Hour, Name: "Drama"},
+		}},
+	}})
+	data.InsertRuleConfig("news", &tv.RuleConfig{ProgramNumber: 101, Start: start, Duration: time.Hour, Name: "News"})
+	if err := server.Client.PostData(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedData, err := server.Client.FetchData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now   time.Time
+		alive bool
+		end   time.Time
+	}{
+		{start.Add(-time.Hour), false, start},
+		{start.Add(time.Minute), true, start.Add(time.Hour)},
+		{start.Add(time.Hour), false, start.Add(25 * time.Hour)},
+	}
+	for _, test := range tests {
+		state := getState(fetchedData, test.now)
+		if state.alive != test.alive || !state.end.Equal(test.end) {
+			t.Errorf("getState(%v) = {%v, %v}, want {%v, %v}", test.now, state.alive, state.end, test.alive, test.end)
+		}
+	}
+}
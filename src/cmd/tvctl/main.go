@@ -1,182 +1,43 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"flag"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/cgi"
-	timepkg "time"
-	"zng.jp/tv"
+	"os"
+	_ "time/tzdata"
+	"zng.jp/tv/ctl"
 )
 
-func processGetJson(writer http.ResponseWriter, request *http.Request) {
-	data, err := readData()
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(writer).Encode(data); err != nil {
-		log.Print("Encode failed: %v", err)
-		return
-	}
-}
-
-func processGetEventStream(writer http.ResponseWriter, request *http.Request) {
-	listenCancel := make(chan struct{})
-	defer close(listenCancel)
-
-	notificationQueue := make(chan struct{})
-	var listenErr error
-	go func() {
-		defer close(notificationQueue)
-		if err := listenData(listenCancel, notificationQueue); err != nil {
-			listenErr = err
-			return
-		}
-	}()
-
-	writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+func main() {
+	listen := flag.String("listen", "", "address to serve HTTP on instead of running as a CGI")
+	assetsDir := flag.String("assets", "", "directory to load templates and static files from instead of the embedded ones, for development")
+	recordingsDir := flag.String("recordings", "/srv/tv", "directory of the recordings to list in the library and stream")
+	flag.Parse()
 
-	var closeDone <-chan bool
-	if closeNotifier, ok := writer.(http.CloseNotifier); ok {
-		closeDone = closeNotifier.CloseNotify()
+	var assets fs.FS = ctl.Assets
+	if *assetsDir != "" {
+		assets = os.DirFS(*assetsDir)
 	}
 
-	for {
-		timer := timepkg.NewTimer(timepkg.Second * 10)
-		defer timer.Stop()
-
-		select {
-		case _, ok := <-notificationQueue:
-			if !ok {
-				if listenErr != nil {
-					log.Print("Listen failed: %v", listenErr)
-				}
-				return
-			}
-			if _, err := io.WriteString(writer, "data: ok\n\n"); err != nil {
-				log.Print("WriteString failed: %v", err)
-				return
-			}
-		case <-timer.C:
-			if _, err := io.WriteString(writer, "\n"); err != nil {
-				log.Print("WriteString failed: %v", err)
-				return
-			}
-		case <-closeDone:
-			return
-		}
-
-		if flusher, ok := writer.(http.Flusher); ok {
-			flusher.Flush()
+	if *listen == "" {
+		handler := ctl.NewHandler(".data", assets)
+		handler.RecordingsDir = *recordingsDir
+		if err := cgi.Serve(handler); err != nil {
+			log.Fatal(err)
 		}
-	}
-}
-
-func processGetHtml(writer http.ResponseWriter, request *http.Request) {
-	data, err := readData()
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
-
-	if err := renderIndex(data, request.URL.Query(), writer); err != nil {
-		log.Print("Render failed: %v", err)
 		return
 	}
-}
 
-func processGet(writer http.ResponseWriter, request *http.Request) {
-	url := request.URL
-	query := url.Query()
-	mode := query.Get("mode")
-	switch mode {
-	case "json":
-		processGetJson(writer, request)
-	case "event-stream":
-		processGetEventStream(writer, request)
-	case "html":
-		processGetHtml(writer, request)
-	default:
-		http.Error(writer, "Unknown mode: "+mode, http.StatusBadRequest)
-	}
-}
-
-func processPostJson(writer http.ResponseWriter, request *http.Request) {
-	if request.Body == nil {
-		http.Error(writer, "Request body is nil", http.StatusInternalServerError)
-		return
-	}
-
-	newData := &tv.Data{}
-	if err := json.NewDecoder(request.Body).Decode(newData); err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := writeData(newData); err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	writer.WriteHeader(http.StatusNoContent)
-}
-
-func processPostHtml(writer http.ResponseWriter, request *http.Request) {
-	if err := request.ParseForm(); err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	newData, err := parseRuleConfig(request.PostForm)
+	handler, err := ctl.NewMemoryHandler(".data", assets)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := writeData(newData); err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	http.Redirect(writer, request, request.URL.String(), http.StatusSeeOther)
-}
-
-func processPost(writer http.ResponseWriter, request *http.Request) {
-	url := request.URL
-	query := url.Query()
-	mode := query.Get("mode")
-	switch mode {
-	case "json":
-		processPostJson(writer, request)
-	case "html":
-		processPostHtml(writer, request)
-	default:
-		http.Error(writer, "Unknown mode: "+mode, http.StatusBadRequest)
-	}
-}
-
-type handler struct {
-}
-
-func (*handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if request.Method == "GET" || request.Method == "HEAD" {
-		processGet(writer, request)
-	} else if request.Method == "POST" {
-		processPost(writer, request)
-	} else {
-		http.Error(writer, "Method "+request.Method+" not allowed", http.StatusMethodNotAllowed)
+		log.Fatal(err)
 	}
-}
+	handler.RecordingsDir = *recordingsDir
 
-func main() {
-	handler := &handler{}
-	if err := cgi.Serve(handler); err != nil {
+	if err := http.ListenAndServe(*listen, handler); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"zng.jp/tv"
+)
+
+const (
+	dataCacheFile    = ".data/tvworker.gob"
+	pendingCacheFile = ".data/tvworker-pending.gob"
+)
+
+func readCache(file string) (*tv.Data, error) {
+	data := &tv.Data{}
+
+	in, err := os.Open(file)
+	if err == nil {
+		defer in.Close()
+		if err := gob.NewDecoder(in).Decode(data); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeCache(file string, data *tv.Data) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+
+	out, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(out).Encode(data); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func isEmptyData(data *tv.Data) bool {
+	return len(data.RuleConfigMap) == 0 && len(data.StreamStateMap) == 0 && len(data.StreamInfoMap) == 0 && len(data.RecordedEpisodeMap) == 0 && len(data.RecordingStateMap) == 0
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
 )
 
 type IdleTask struct {
 }
 
-func (task *IdleTask) Run(done <-chan struct{}) error {
+func (task *IdleTask) Run(ctx context.Context, assignments []int32) error {
 	log.Print("Yielding...")
-	<-done
+	<-ctx.Done()
 	return nil
 }
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+	"zng.jp/tv"
+	"zng.jp/tv/db"
+)
+
+// A clock tells the job loop the time, which the simulation advances on its
+// own.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct {
+}
+
+func (clock *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// A taskRunner runs the task of the job with its assignments until it ends or
+// ctx is done, then sends the job with the error of the task to done.
+type taskRunner interface {
+	Start(ctx context.Context, job *job, done chan<- *job)
+}
+
+type goroutineRunner struct {
+}
+
+func (runner *goroutineRunner) Start(ctx context.Context, job *job, done chan<- *job) {
+	go func() {
+		job.err = job.task.Run(ctx, job.assignments)
+		done <- job
+	}()
+}
+
+// A dataSource holds the data the job loop schedules from, and takes the data
+// the loop and its tasks produce.
+type dataSource interface {
+	Data() *tv.Data
+	Queue(newData *tv.Data)
+}
+
+// tvctlSource keeps the data of tvctl with the data not posted yet merged in,
+// caching both so that tvworker works while tvctl is unreachable.
+type tvctlSource struct {
+	ctx         context.Context
+	data        *tv.Data
+	pendingData *tv.Data
+	postedData  *tv.Data
+	postDone    chan error
+	fetchDone   chan *fetchResult
+	fetching    bool
+	// refetching is whether the data changed again during the fetch in
+	// flight, so that it is fetched again.
+	refetching bool
+	// retryTime is when the pending data is posted again after a failed
+	// post, or zero if it is not waiting for a retry.
+	retryTime time.Time
+}
+
+// postRetryInterval is how long tvworker waits before posting again the data
+// whose post failed, when nothing else has made it post since.
+const postRetryInterval = time.Minute
+
+func newTvctlSource(ctx context.Context) *tvctlSource {
+	data, err := readCache(dataCacheFile)
+	if err != nil {
+		log.Printf("readCache failed: %v", err)
+		data = &tv.Data{}
+	}
+	pendingData, err := readCache(pendingCacheFile)
+	if err != nil {
+		log.Printf("readCache failed: %v", err)
+		pendingData = &tv.Data{}
+	}
+	data.MergeData(pendingData)
+	return &tvctlSource{
+		ctx:         ctx,
+		data:        data,
+		pendingData: pendingData,
+		postDone:    make(chan error),
+		fetchDone:   make(chan *fetchResult, 1),
+	}
+}
+
+type fetchResult struct {
+	data *tv.Data
+	err  error
+}
+
+func (source *tvctlSource) Data() *tv.Data {
+	return source.data
+}
+
+func (source *tvctlSource) Queue(newData *tv.Data) {
+	source.data.MergeData(newData)
+	source.pendingData.MergeData(newData)
+	if err := writeCache(pendingCacheFile, source.pendingData); err != nil {
+		log.Printf("writeCache failed: %v", err)
+	}
+	source.Post()
+}
+
+// Post posts the pending data unless a post is in flight, whose result is sent
+// to PostDone.
+func (source *tvctlSource) Post() {
+	if source.postedData != nil || isEmptyData(source.pendingData) {
+		return
+	}
+	source.postedData = source.pendingData
+	source.pendingData = &tv.Data{}
+	source.retryTime = time.Time{}
+	go func(data *tv.Data) {
+		source.postDone <- db.PostData(source.ctx, data)
+	}(source.postedData)
+}
+
+func (source *tvctlSource) PostDone() <-chan error {
+	return source.postDone
+}
+
+// Posting reports whether a post is in flight.
+func (source *tvctlSource) Posting() bool {
+	return source.postedData != nil
+}
+
+// FinishPost takes the result of the post in flight, keeping its data pending
+// if it is worth retrying.
+func (source *tvctlSource) FinishPost(err error) {
+	if db.IsPermanent(err) {
+		log.Printf("PostData failed permanently: %v", err)
+	} else if err != nil {
+		log.Printf("PostData failed: %v", err)
+		source.postedData.MergeData(source.pendingData)
+		source.pendingData = source.postedData
+		source.retryTime = time.Now().Add(postRetryInterval)
+	}
+	source.postedData = nil
+	if err := writeCache(pendingCacheFile, source.pendingData); err != nil {
+		log.Printf("writeCache failed: %v", err)
+	}
+}
+
+// RetryTime returns when the data whose post failed is posted again, or zero
+// if none is waiting.
+func (source *tvctlSource) RetryTime() time.Time {
+	return source.retryTime
+}
+
+// Retry posts the data whose post failed if its retry is due.
+func (source *tvctlSource) Retry(now time.Time) {
+	if !source.retryTime.IsZero() && !now.Before(source.retryTime) {
+		source.Post()
+	}
+}
+
+// Fetch fetches the data of tvctl in the background after posting what is
+// pending, without blocking the job loop while tvctl is unreachable. The
+// result is sent to FetchDone.
+func (source *tvctlSource) Fetch() {
+	source.Post()
+	if source.fetching {
+		source.refetching = true
+		return
+	}
+	source.fetching = true
+	go func() {
+		data, err := db.FetchData(source.ctx)
+		source.fetchDone <- &fetchResult{data: data, err: err}
+	}()
+}
+
+func (source *tvctlSource) FetchDone() <-chan *fetchResult {
+	return source.fetchDone
+}
+
+// FinishFetch replaces the data with the fetched one, with the data not posted
+// yet merged in.
+func (source *tvctlSource) FinishFetch(result *fetchResult) {
+	source.fetching = false
+	if source.refetching {
+		source.refetching = false
+		source.Fetch()
+	}
+	if result.err != nil {
+		log.Printf("fetchData failed: %v", result.err)
+		return
+	}
+	source.data = result.data
+	if err := writeCache(dataCacheFile, source.data); err != nil {
+		log.Printf("writeCache failed: %v", err)
+	}
+	source.data.MergeData(source.pendingData)
+	if source.postedData != nil {
+		source.data.MergeData(source.postedData)
+	}
+}
+
+// jobLoop runs the scheduled tasks as jobs on the tuners, stopping those no
+// longer scheduled and retrying those failing.
+type jobLoop struct {
+	clock     clock
+	runner    taskRunner
+	source    dataSource
+	results   chan *tv.Data
+	processor *postProcessor
+	// spaceWarning warns of the recordings that may not fit on the disk if
+	// it is not nil.
+	spaceWarning func(data *tv.Data, event *tv.Event, now time.Time) string
+
+	commands   map[chan io.Writer]*command
+	recordings []*tv.Recording
+	jobs       []*job
+	resources  map[int32][]int32
+	failures   []*failure
+	done       chan *job
+}
+
+func newJobLoop(clock clock, runner taskRunner, source dataSource, results chan *tv.Data, processor *postProcessor) *jobLoop {
+	loop := &jobLoop{
+		clock:     clock,
+		runner:    runner,
+		source:    source,
+		results:   results,
+		processor: processor,
+		commands:  make(map[chan io.Writer]*command),
+		resources: make(map[int32][]int32),
+		done:      make(chan *job),
+	}
+	for system, count := range tv.Tuners {
+		for tuner := 0; tuner < count; tuner++ {
+			loop.resources[system] = append(loop.resources[system], int32(tuner))
+		}
+	}
+	return loop
+}
+
+// Done receives the jobs that ended, which are passed to Finish.
+func (loop *jobLoop) Done() <-chan *job {
+	return loop.done
+}
+
+// Step plans the recordings, stops the jobs no longer scheduled and starts the
+// scheduled tasks, returning when it should be called again.
+func (loop *jobLoop) Step(ctx context.Context) time.Time {
+	now := loop.clock.Now()
+	data := loop.source.Data()
+	recordings, _ := data.PlanRecordings(now, now.Add(planHorizon))
+	loop.recordings = recordings
+	if newData := rebroadcastData(data, recordings); newData != nil {
+		log.Print("Recording rebroadcasts instead of conflicting events.")
+		loop.source.Queue(newData)
+	}
+	if newData := scheduledStateData(data, recordings, now, loop.spaceWarning); newData != nil {
+		loop.source.Queue(newData)
+	}
+
+	tasks, nextTime := schedule(data, recordings, loop.commands, loop.results, loop.processor, now)
+
+	// The failures of tasks no longer scheduled are forgotten.
+	var scheduledFailures []*failure
+	for _, failure := range loop.failures {
+		for _, task := range tasks {
+			if failure.task.Equals(task) {
+				scheduledFailures = append(scheduledFailures, failure)
+				break
+			}
+		}
+	}
+	loop.failures = scheduledFailures
+
+	for _, job := range loop.jobs {
+		shouldRun := false
+		for _, task := range tasks {
+			if job.task.Equals(task) {
+				if updater, ok := job.task.(Updater); ok {
+					updater.Update(task)
+				}
+				shouldRun = true
+				break
+			}
+		}
+
+		if shouldRun {
+			continue
+		}
+
+		if job.canceling {
+			continue
+		}
+
+		if event := preemptedEvent(job.task, recordings, now); event != nil {
+			log.Printf("Preempting %s for a recording of higher priority: %v", event.Info.Name, job.task)
+		} else {
+			log.Printf("Terminating task: %v", job.task)
+		}
+		job.cancel()
+		job.canceling = true
+	}
+
+	for _, task := range tasks {
+		running := false
+		for _, job := range loop.jobs {
+			if task.Equals(job.task) {
+				running = true
+				break
+			}
+		}
+
+		if running {
+			continue
+		}
+
+		waiting := false
+		var taskFailure *failure
+		for _, failure := range loop.failures {
+			if !task.Equals(failure.task) {
+				continue
+			}
+			taskFailure = failure
+			if failure.count > maxRetries {
+				waiting = true
+			} else if now.Before(failure.retryAt) {
+				waiting = true
+				if failure.retryAt.Before(nextTime) {
+					nextTime = failure.retryAt
+				}
+			}
+			break
+		}
+
+		if waiting {
+			continue
+		}
+
+		runnable := true
+		for _, requirement := range task.Requirements() {
+			if len(loop.resources[requirement]) <= 0 {
+				runnable = false
+			}
+		}
+
+		if !runnable {
+			continue
+		}
+
+		var plannedTuners []int32
+		if planner, ok := task.(TunerPlanner); ok {
+			plannedTuners = planner.PlannedTuners()
+		}
+		assignments := make([]int32, len(task.Requirements()))
+		for i, requirement := range task.Requirements() {
+			preferred := int32(-1)
+			// A task that failed on its planned tuner fails over to
+			// another.
+			if i < len(plannedTuners) && (taskFailure == nil || !taskFailure.tuners[plannedTuners[i]]) {
+				preferred = plannedTuners[i]
+			}
+			assignments[i] = loop.takeResource(requirement, preferred)
+		}
+
+		jobCtx, cancel := context.WithCancel(ctx)
+
+		job := &job{
+			task:        task,
+			assignments: assignments,
+			cancel:      cancel,
+			started:     now,
+		}
+
+		loop.jobs = append(loop.jobs, job)
+
+		log.Printf("Starting task: %v", job.task)
+		loop.runner.Start(jobCtx, job, loop.done)
+	}
+
+	return nextTime
+}
+
+// takeResource takes a free tuner of the system, which is the preferred one if
+// it is free.
+func (loop *jobLoop) takeResource(system int32, preferred int32) int32 {
+	resources := loop.resources[system]
+	index := len(resources) - 1
+	for i, resource := range resources {
+		if resource == preferred {
+			index = i
+			break
+		}
+	}
+	resource := resources[index]
+	loop.resources[system] = append(resources[0:index], resources[index+1:]...)
+	return resource
+}
+
+// preemptedEvent returns the event the task records whose recording has been
+// preempted by now, or nil if there is none.
+func preemptedEvent(task Task, recordings []*tv.Recording, now time.Time) *tv.Event {
+	recordTask, ok := task.(*RecordTask)
+	if !ok {
+		return nil
+	}
+	recordTask.mutex.Lock()
+	defer recordTask.mutex.Unlock()
+
+	for _, event := range recordTask.Events {
+		for _, recording := range recordings {
+			if recording.Event.RecordingId() == event.RecordingId() && !recording.PreemptedAt.IsZero() && !now.Before(recording.PreemptedAt) {
+				return event
+			}
+		}
+	}
+	return nil
+}
+
+func (loop *jobLoop) remove(doneJob *job) {
+	for i, job := range loop.jobs {
+		if doneJob == job {
+			loop.jobs[i] = loop.jobs[len(loop.jobs)-1]
+			loop.jobs = loop.jobs[0 : len(loop.jobs)-1]
+			break
+		}
+	}
+}
+
+// Finish frees the tuners of the job that ended, and schedules the retry of
+// its task if it failed.
+func (loop *jobLoop) Finish(doneJob *job) {
+	doneJob.cancel()
+	loop.remove(doneJob)
+	failed := doneJob.err != nil
+	if !failed {
+		log.Printf("Task finished: %v", doneJob.task)
+	}
+	for i, requirement := range doneJob.task.Requirements() {
+		if failed {
+			// Another tuner of the system is tried first.
+			loop.resources[requirement] = append([]int32{doneJob.assignments[i]}, loop.resources[requirement]...)
+		} else {
+			loop.resources[requirement] = append(loop.resources[requirement], doneJob.assignments[i])
+		}
+	}
+	if !failed {
+		return
+	}
+
+	now := loop.clock.Now()
+	var taskFailure *failure
+	for _, failure := range loop.failures {
+		if failure.task.Equals(doneJob.task) {
+			taskFailure = failure
+			break
+		}
+	}
+	if taskFailure == nil || now.Sub(doneJob.started) >= stableRunTime {
+		if taskFailure == nil {
+			taskFailure = &failure{task: doneJob.task}
+			loop.failures = append(loop.failures, taskFailure)
+		}
+		taskFailure.count = 0
+		taskFailure.tuners = make(map[int32]bool)
+	}
+	taskFailure.count++
+	repeated := false
+	for _, tuner := range doneJob.assignments {
+		if taskFailure.tuners[tuner] {
+			repeated = true
+		}
+		taskFailure.tuners[tuner] = true
+	}
+	if _, ok := doneJob.task.(*RecordTask); ok && !repeated {
+		// A gap in a recording is kept short by failing over to
+		// another tuner at once.
+		taskFailure.retryAt = now
+	} else {
+		taskFailure.retryAt = now.Add(retryDelayAfter(taskFailure.count))
+	}
+	retryAt := taskFailure.retryAt
+	if taskFailure.count > maxRetries {
+		log.Printf("Giving up on task after %d failures: %v: %v", taskFailure.count, doneJob.task, doneJob.err)
+		retryAt = time.Time{}
+	} else {
+		log.Printf("Task failed %d times, retrying at %s: %v: %v", taskFailure.count, retryAt.Format("15:04:05"), doneJob.task, doneJob.err)
+	}
+	if reporter, ok := doneJob.task.(FailureReporter); ok {
+		if newData := reporter.FailureData(loop.source.Data(), doneJob.err, retryAt); newData != nil {
+			loop.source.Queue(newData)
+		}
+	}
+}
+
+// Stop cancels the jobs so that their work is resumed when tvworker restarts,
+// and waits for them and then for the post-processor, queuing what they report
+// while stopping.
+func (loop *jobLoop) Stop() {
+	for _, job := range loop.jobs {
+		if suspender, ok := job.task.(Suspender); ok {
+			suspender.Suspend()
+		}
+		if !job.canceling {
+			job.cancel()
+			job.canceling = true
+		}
+	}
+	for len(loop.jobs) > 0 {
+		select {
+		case doneJob := <-loop.done:
+			log.Printf("Task stopped: %v", doneJob.task)
+			loop.remove(doneJob)
+		case result := <-loop.results:
+			loop.source.Queue(result)
+		}
+	}
+
+	if loop.processor == nil {
+		return
+	}
+	processorDone := make(chan struct{})
+	go func() {
+		loop.processor.Stop()
+		close(processorDone)
+	}()
+	for {
+		select {
+		case <-processorDone:
+			return
+		case result := <-loop.results:
+			loop.source.Queue(result)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"log"
+	"testing"
+	"time"
+	"zng.jp/tv"
+)
+
+// stoppingTask processes a recording when it is cancelled.
+type stoppingTask struct {
+	processor *postProcessor
+}
+
+func (task *stoppingTask) Equals(otherTask Task) bool {
+	return task == otherTask
+}
+
+func (task *stoppingTask) Requirements() []int32 {
+	return nil
+}
+
+func (task *stoppingTask) Run(ctx context.Context, assignments []int32) error {
+	<-ctx.Done()
+	task.processor.Enqueue(newPostProcessEvent(), &tv.RecordingState{File: "News.ts"})
+	return nil
+}
+
+func TestLoopStopWaitsForProcessor(t *testing.T) {
+	results := make(chan *tv.Data)
+	processor := newPostProcessor(&postProcessConfig{
+		Workers: 1,
+		Steps:   []*postProcessStep{{Name: "sleep", Command: []string{"sleep", "60"}}},
+	}, results)
+	source := &fileSource{data: &tv.Data{}}
+	loop := newJobLoop(&systemClock{}, &goroutineRunner{}, source, results, processor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &job{task: &stoppingTask{processor: processor}, cancel: cancel, started: time.Now()}
+	loop.jobs = append(loop.jobs, job)
+	loop.runner.Start(ctx, job, loop.done)
+
+	stopped := make(chan struct{})
+	go func() {
+		loop.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop does not return")
+	}
+
+	state := source.data.RecordingState(newPostProcessEvent())
+	if state == nil || len(state.PostProcess) != 1 || state.PostProcess[0].Status == tv.PostProcessRunning {
+		t.Errorf("RecordingState = %+v, want the step reported as pending or failed", state)
+	}
+}
+
+func TestRecordTaskFailsOverAtOnce(t *testing.T) {
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	data.InsertStreamInfo("00101", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 101, Title: "NHK BS1", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "News"},
+		}},
+	}})
+	task := &RecordTask{Events: data.Events()}
+
+	clock := &simulatedClock{now: start.Add(time.Minute)}
+	loop := newJobLoop(clock, &simulatedRunner{clock: clock}, &fileSource{data: data}, nil, nil)
+	fail := func(tuner int32) time.Duration {
+		job := &job{task: task, assignments: []int32{tuner}, cancel: func() {}, started: clock.now, err: errSuspended}
+		loop.jobs = append(loop.jobs, job)
+		loop.Finish(job)
+		return loop.failures[0].retryAt.Sub(clock.now)
+	}
+
+	if delay := fail(0); delay != 0 {
+		t.Errorf("Retried %v after failing on a tuner, want at once", delay)
+	}
+	if delay := fail(1); delay != 0 {
+		t.Errorf("Retried %v after failing on another tuner, want at once", delay)
+	}
+	if delay := fail(0); delay != retryDelayAfter(3) {
+		t.Errorf("Retried %v after failing again on a tuner, want %v", delay, retryDelayAfter(3))
+	}
+}
+
+// recordedNames returns the names of the events the running jobs record.
+func recordedNames(loop *jobLoop) map[string]bool {
+	names := make(map[string]bool)
+	for _, job := range loop.jobs {
+		if task, ok := job.task.(*RecordTask); ok {
+			for _, event := range task.Events {
+				names[event.Info.Name] = true
+			}
+		}
+	}
+	return names
+}
+
+func TestLoopReservesTunerForHigherPriority(t *testing.T) {
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	for _, stream := range data.Streams() {
+		data.InsertStreamState(stream.Id, &tv.StreamState{Time: start})
+	}
+	for _, program := range []struct {
+		streamId tv.StreamId
+		number   int32
+		info     *tv.EventInfo
+		priority int32
+	}{
+		{"00101", 101, &tv.EventInfo{Start: start, Duration: 2 * time.Hour, Name: "First"}, 0},
+		{"00103", 103, &tv.EventInfo{Start: start, Duration: 2 * time.Hour, Name: "Second"}, 0},
+		{"00141", 141, &tv.EventInfo{Start: start.Add(time.Hour), Duration: 30 * time.Minute, Name: "Important"}, 5},
+	} {
+		data.InsertStreamInfo(program.streamId, &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+			{Number: program.number, Title: string(program.streamId), Events: []*tv.EventInfo{program.info}},
+		}})
+		data.InsertRuleConfig(tv.RuleId(program.info.Name), &tv.RuleConfig{
+			ProgramNumber: program.number,
+			Start:         program.info.Start,
+			Duration:      program.info.Duration,
+			Name:          program.info.Name,
+			Priority:      program.priority,
+		})
+	}
+
+	source := &fileSource{data: data}
+	clock := &simulatedClock{now: start.Add(-5 * time.Minute)}
+	runner := &simulatedRunner{clock: clock, source: source}
+	loop := newJobLoop(clock, runner, source, nil, nil)
+	defer log.SetPrefix(log.Prefix())
+
+	runSimulation(loop, runner, start.Add(30*time.Minute))
+	names := recordedNames(loop)
+	if len(names) != 1 || names["Important"] {
+		t.Fatalf("Recording %v, want one of the recordings of lower priority", names)
+	}
+
+	runSimulation(loop, runner, start.Add(70*time.Minute))
+	if names := recordedNames(loop); len(names) != 2 || !names["Important"] {
+		t.Errorf("Recording %v, want the recording of higher priority on the reserved tuner", names)
+	}
+	for _, job := range loop.jobs {
+		task := job.task.(*RecordTask)
+		for _, recording := range loop.recordings {
+			if recording.Event.Id() == task.Events[0].Id() && recording.Tuner != job.assignments[0] {
+				t.Errorf("%s is recorded on tuner %d, want the planned %d", recording.Event.Info.Name, job.assignments[0], recording.Tuner)
+			}
+		}
+	}
+
+	runSimulation(loop, runner, start.Add(100*time.Minute))
+	if names := recordedNames(loop); len(names) != 2 || names["Important"] {
+		t.Errorf("Recording %v, want both recordings of lower priority once the tuner is free", names)
+	}
+	if len(runner.runs) != len(loop.jobs) {
+		t.Errorf("%d tasks run for %d jobs", len(runner.runs), len(loop.jobs))
+	}
+}
+
+func TestLoopRecordsOnPlannedTuner(t *testing.T) {
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	for _, stream := range data.Streams() {
+		data.InsertStreamState(stream.Id, &tv.StreamState{Time: start})
+	}
+	data.InsertStreamInfo("00101", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 101, Title: "NHK BS1", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "News"},
+		}},
+	}})
+	data.InsertRuleConfig("news", &tv.RuleConfig{ProgramNumber: 101, Start: start, Duration: time.Hour, Name: "News"})
+
+	source := &fileSource{data: data}
+	clock := &simulatedClock{now: start.Add(-5 * time.Minute)}
+	runner := &simulatedRunner{clock: clock, source: source}
+	loop := newJobLoop(clock, runner, source, nil, nil)
+	defer log.SetPrefix(log.Prefix())
+
+	runSimulation(loop, runner, start.Add(time.Minute))
+	if len(loop.jobs) != 1 || len(loop.recordings) != 1 {
+		t.Fatalf("Running %d jobs for %d recordings, want 1", len(loop.jobs), len(loop.recordings))
+	}
+	if tuner := loop.recordings[0].Tuner; loop.jobs[0].assignments[0] != tuner {
+		t.Errorf("Recording on tuner %d, want the planned %d", loop.jobs[0].assignments[0], tuner)
+	}
+}
@@ -1,27 +1,93 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sort"
 	"strconv"
+	"syscall"
 	"time"
 	"zng.jp/tv"
 	"zng.jp/tv/db"
 )
 
+const planHorizon = 7 * 24 * time.Hour
+
+// playLeadTime is how long before a recording its tuner is kept from plays
+// and scans, so that they have stopped when the recording starts.
+const playLeadTime = time.Minute
+
+// shutdownPostTimeout is how long tvworker tries to post the last data when it
+// stops, which is otherwise posted when it restarts.
+const shutdownPostTimeout = 10 * time.Second
+
+// startTime is when tvworker started, before which captures were made by an
+// earlier process.
+var startTime = time.Now()
+
+// A task failing on its own is retried after retryDelay, doubled for each
+// further failure up to maxRetryDelay, up to maxRetries times. The failures
+// are counted afresh once a run has lasted stableRunTime. A recording is
+// retried at once on another tuner, and only waits after failing again on a
+// tuner it has failed on.
+const (
+	retryDelay    = 10 * time.Second
+	maxRetryDelay = 5 * time.Minute
+	maxRetries    = 5
+	stableRunTime = 5 * time.Minute
+)
+
 type command struct {
 	deleted       bool
 	writer        chan io.Writer
 	programNumber int32
+	result        chan<- commandResult
+}
+
+type commandResult struct {
+	// until is when the play is stopped for a recording, or zero if no
+	// recording is planned to need its tuner.
+	until time.Time
+	err   error
 }
 
 type job struct {
 	task        Task
 	assignments []int32
 	canceling   bool
-	cancel      chan struct{}
+	cancel      context.CancelFunc
+	started     time.Time
+	err         error
+}
+
+// failure tracks the retries of a task failing on its own.
+type failure struct {
+	task    Task
+	count   int
+	retryAt time.Time
+	// tuners are the tuners the task has failed on since the failures
+	// were counted afresh.
+	tuners map[int32]bool
+}
+
+// retryDelayAfter returns how long a task is retried after failing the given
+// number of times in a row.
+func retryDelayAfter(count int) time.Duration {
+	delay := retryDelay
+	for i := 1; i < count && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
 }
 
 type minTimeTracker struct {
@@ -55,13 +121,23 @@ type scheduler struct {
 	resources map[int32]int
 }
 
-func (s *scheduler) MaybeAdd(task Task) {
+func (s *scheduler) init() {
 	if s.resources == nil {
-		s.resources = map[int32]int{
-			tv.ISDB_T: 2,
-			tv.ISDB_S: 2,
+		s.resources = make(map[int32]int)
+		for system, count := range tv.Tuners {
+			s.resources[system] = count
 		}
 	}
+}
+
+// Reserve keeps a tuner of the system from the tasks added later.
+func (s *scheduler) Reserve(system int32) {
+	s.init()
+	s.resources[system]--
+}
+
+func (s *scheduler) MaybeAdd(task Task) {
+	s.init()
 	for _, requirement := range task.Requirements() {
 		if s.resources[requirement] <= 0 {
 			return
@@ -73,27 +149,156 @@ func (s *scheduler) MaybeAdd(task Task) {
 	s.tasks = append(s.tasks, task)
 }
 
-func schedule(data *tv.Data, commands map[chan io.Writer]*command, now time.Time) ([]Task, time.Time) {
+// rebroadcastData returns the rules for recording the rebroadcasts chosen in
+// place of conflicting events, so that the choice survives the original
+// airing leaving the EPG.
+func rebroadcastData(data *tv.Data, recordings []*tv.Recording) *tv.Data {
+	var newData *tv.Data
+	for _, recording := range recordings {
+		if recording.Original == nil {
+			continue
+		}
+		event := recording.Event
+		id := tv.RebroadcastRuleId(recording.Rule.Id, event)
+		if _, ok := data.RuleConfigMap[id]; ok {
+			continue
+		}
+		if newData == nil {
+			newData = &tv.Data{}
+		}
+		// The rebroadcast is planned and kept as the original rule would.
+		config := recording.Rule.Config
+		newData.InsertRuleConfig(id, &tv.RuleConfig{
+			ProgramNumber:  event.Program.Info.Number,
+			Start:          event.Info.Start,
+			Duration:       event.Info.Duration,
+			Name:           event.Info.Name,
+			Priority:       config.Priority,
+			Preempt:        config.Preempt,
+			KeepEpisodes:   config.KeepEpisodes,
+			KeepDays:       config.KeepDays,
+			KeepForever:    config.KeepForever,
+			Reason:         recording.Reason(),
+			OriginalRuleId: recording.Rule.Id,
+		})
+	}
+	return newData
+}
+
+// scheduledStateData returns the states of the recordings whose tuners are
+// being reserved and that have no state yet, warning of those that may not fit
+// on the disk if spaceWarning is not nil.
+func scheduledStateData(data *tv.Data, recordings []*tv.Recording, now time.Time, spaceWarning func(*tv.Data, *tv.Event, time.Time) string) *tv.Data {
+	var newData *tv.Data
+	for _, recording := range recordings {
+		event := recording.Event
+		if recording.Tuner < 0 || recording.Replacement != nil || !now.Before(event.Info.Start) || !event.Info.Start.Before(now.Add(playLeadTime)) {
+			continue
+		}
+		if data.RecordingState(event) != nil {
+			continue
+		}
+		if newData == nil {
+			newData = &tv.Data{}
+		}
+		state := &tv.RecordingState{
+			Status:        tv.RecordingScheduled,
+			ProgramNumber: event.Program.Info.Number,
+			Name:          event.Info.Name,
+			EventStart:    event.Info.Start,
+		}
+		if spaceWarning != nil {
+			state.Warning = spaceWarning(data, event, now)
+		}
+		newData.InsertRecordingState(event.RecordingId(), state)
+	}
+	return newData
+}
+
+func schedule(data *tv.Data, recordings []*tv.Recording, commands map[chan io.Writer]*command, results chan<- *tv.Data, processor *postProcessor, now time.Time) ([]Task, time.Time) {
 	nextTime := minTimeTracker{time: now.Add(24 * time.Hour)}
 	scheduler := scheduler{}
 
 	var eventsToRecord []*tv.Event
-	for _, event := range data.Events() {
-		if event.Info == nil {
-			continue
-		}
-		if data.RuleMatchingEvent(event) == nil {
+	var eventsToReserve []*tv.Event
+	rules := make(map[tv.RecordingId]*tv.Rule)
+	tuners := make(map[tv.RecordingId]int32)
+	for _, recording := range recordings {
+		rules[recording.Event.RecordingId()] = recording.Rule
+		tuners[recording.Event.RecordingId()] = recording.Tuner
+	}
+	for _, recording := range recordings {
+		if recording.Replacement != nil {
 			continue
 		}
-		if event.IsCurrent(now) {
+		event := recording.Event
+		if recording.IsRecording(now) {
 			eventsToRecord = append(eventsToRecord, event)
 			nextTime.Update(event.End())
+			if !recording.PreemptedAt.IsZero() {
+				nextTime.Update(recording.PreemptedAt)
+			}
 		} else if now.Before(event.Info.Start) {
-			nextTime.Update(event.Info.Start)
+			if recording.Tuner >= 0 && event.Info.Start.Before(now.Add(playLeadTime)) {
+				eventsToReserve = append(eventsToReserve, event)
+				nextTime.Update(event.Info.Start)
+			} else if reserveTime := event.Info.Start.Add(-playLeadTime); now.Before(reserveTime) {
+				nextTime.Update(reserveTime)
+			} else {
+				// The recording has no tuner to reserve.
+				nextTime.Update(event.Info.Start)
+			}
 		}
 	}
+	// The events following recorded ones on the same program are recorded
+	// by the same tasks, so that the capture continues across them.
+	for _, recording := range recordings {
+		if recording.Tuner < 0 || recording.Replacement != nil || !recording.PreemptedAt.IsZero() {
+			continue
+		}
+		event := recording.Event
+		for _, recordedEvent := range eventsToRecord {
+			if recordedEvent.Program.Info.Number == event.Program.Info.Number && recordedEvent.End().Equal(event.Info.Start) {
+				eventsToRecord = append(eventsToRecord, event)
+				break
+			}
+		}
+	}
+	var recordTasks []*RecordTask
 	for _, event := range eventsToRecord {
-		scheduler.MaybeAdd(&RecordTask{Event: event})
+		var eventTask *RecordTask
+		for _, task := range recordTasks {
+			if task.Events[0].Program.Stream.SharesTransport(event.Program.Stream) {
+				eventTask = task
+				break
+			}
+		}
+		if eventTask == nil {
+			eventTask = &RecordTask{
+				Results:       results,
+				States:        make(map[tv.RecordingId]*tv.RecordingState),
+				Rules:         make(map[tv.RecordingId]*tv.Rule),
+				PostProcessor: processor,
+				Tuner:         tuners[event.RecordingId()],
+			}
+			recordTasks = append(recordTasks, eventTask)
+		}
+		eventTask.Events = append(eventTask.Events, event)
+		eventTask.Rules[event.RecordingId()] = rules[event.RecordingId()]
+		if state := data.RecordingState(event); state != nil {
+			eventTask.States[event.RecordingId()] = state
+		}
+	}
+	for _, task := range recordTasks {
+		scheduler.MaybeAdd(task)
+	}
+	reservedEvents := append([]*tv.Event{}, eventsToRecord...)
+	for _, event := range eventsToReserve {
+		newReservedEvents := append(reservedEvents, event)
+		if tv.CountTransports(newReservedEvents) > tv.CountTransports(reservedEvents) {
+			scheduler.Reserve(event.Program.Stream.Config.System)
+		}
+		reservedEvents = newReservedEvents
 	}
 
 	programs := make(map[int32]*tv.Program)
@@ -120,12 +325,53 @@ func schedule(data *tv.Data, commands map[chan io.Writer]*command, now time.Time
 	}
 	sort.Sort(streamsByStateTime(streamsToScan))
 	for _, stream := range streamsToScan {
-		scheduler.MaybeAdd(&ScanTask{Time: now, Stream: stream})
+		scheduler.MaybeAdd(&ScanTask{Time: now, Stream: stream, Results: results})
 	}
 
 	return scheduler.tasks, nextTime.time
 }
 
+// playUntil returns when a play of the program would be stopped for a
+// planned recording, or an error if it would take a tuner needed now or
+// within playLeadTime.
+func playUntil(data *tv.Data, recordings []*tv.Recording, commands map[chan io.Writer]*command, programNumber int32, now time.Time) (time.Time, error) {
+	program := data.FindProgram(programNumber)
+	if program == nil {
+		return time.Time{}, fmt.Errorf("Unknown program: %d", programNumber)
+	}
+	system := program.Stream.Config.System
+
+	plays := 0
+	for _, command := range commands {
+		if otherProgram := data.FindProgram(command.programNumber); otherProgram != nil && otherProgram.Stream.Config.System == system {
+			plays++
+		}
+	}
+
+	times := []time.Time{now}
+	for _, recording := range recordings {
+		if now.Before(recording.Event.Info.Start) {
+			times = append(times, recording.Event.Info.Start)
+		}
+	}
+	for _, t := range times {
+		var events []*tv.Event
+		for _, recording := range recordings {
+			if recording.Replacement == nil && recording.Event.Program.Stream.Config.System == system && recording.IsRecording(t) {
+				events = append(events, recording.Event)
+			}
+		}
+		if plays+tv.CountTransports(events) < tv.Tuners[system] {
+			continue
+		}
+		if t.Before(now.Add(playLeadTime)) {
+			return time.Time{}, errors.New("All tuners are taken by recordings or other plays")
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
 type commandHandler struct {
 	commandQueue chan<- *command
 }
@@ -141,13 +387,24 @@ func (handler *commandHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 		return
 	}
 	log.Print(request)
-	writer.Header().Set("Content-Type", "video/mp2t")
 	writerSemaphore := make(chan io.Writer, 1)
-	writerSemaphore <- writer
+	result := make(chan commandResult, 1)
 	handler.commandQueue <- &command{
 		writer:        writerSemaphore,
 		programNumber: int32(programNumber),
+		result:        result,
+	}
+	commandResult := <-result
+	if commandResult.err != nil {
+		log.Printf("Refusing to play: %v", commandResult.err)
+		http.Error(writer, commandResult.err.Error(), http.StatusServiceUnavailable)
+		return
 	}
+	if !commandResult.until.IsZero() {
+		writer.Header().Set("X-Tv-Play-Until", commandResult.until.Format(time.RFC3339))
+	}
+	writer.Header().Set("Content-Type", "video/mp2t")
+	writerSemaphore <- writer
 	<-request.Context().Done()
 	handler.commandQueue <- &command{
 		deleted: true,
@@ -162,138 +419,147 @@ func listenCommands(commandQueue chan<- *command) error {
 }
 
 func main() {
-	notificationQueue := make(chan struct{})
-	go func() {
-		defer close(notificationQueue)
-		for {
-			err := db.ListenData(notificationQueue)
-			log.Printf("Listen failed: %v", err)
-			time.Sleep(30 * time.Second)
+	flag.StringVar(&db.DefaultClient.Url, "tvctl", db.DefaultClient.Url, "URL of tvctl")
+	flag.BoolVar(&writeNfo, "nfo", false, "write Kodi .nfo files next to recordings")
+	flag.Int64Var(&minFreeGB, "min-free-gb", 0, "gigabytes (10^9 bytes) of free space to keep by deleting the oldest recordings, or 0 to keep all")
+	postProcessFile := flag.String("postprocess", "", "JSON file listing the steps processing finished recordings")
+	simulateFile := flag.String("simulate", "", "JSON file of data as served by tvctl to simulate scheduling from instead of running tasks")
+	simulateFrom := flag.String("from", "", "RFC 3339 time the simulation starts at, or empty for now")
+	simulateTo := flag.String("to", "", "RFC 3339 time the simulation stops at, or empty for a week after -from")
+	flag.Parse()
+
+	if *simulateFile != "" {
+		from, to, err := parseSimulationTimes(*simulateFrom, *simulateTo)
+		if err != nil {
+			log.Fatalf("parseSimulationTimes failed: %v", err)
 		}
-	}()
+		if err := simulate(*simulateFile, from, to); err != nil {
+			log.Fatalf("simulate failed: %v", err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+
+	notificationQueue := make(chan struct{})
+	go db.ListenData(ctx, notificationQueue)
 
 	commandQueue := make(chan *command)
 	go func() {
 		err := listenCommands(commandQueue)
-		log.Fatal("listenCommands failed: %v", err)
+		log.Fatalf("listenCommands failed: %v", err)
 	}()
 
-	data := &tv.Data{}
-	commands := make(map[chan io.Writer]*command)
-	jobs := []*job{}
-	resources := map[int32][]int32{
-		tv.ISDB_S: []int32{0, 1},
-		tv.ISDB_T: []int32{0, 1},
-	}
-	jobDone := make(chan *job)
-
-	for {
-		tasks, nextTime := schedule(data, commands, time.Now())
-
-		for _, job := range jobs {
-			shouldRun := false
-			for _, task := range tasks {
-				if job.task.Equals(task) {
-					shouldRun = true
-					break
-				}
-			}
-
-			if shouldRun {
-				continue
-			}
+	source := newTvctlSource(ctx)
+	// The data cached when tvworker stopped is posted without waiting
+	// for anything else to be queued.
+	source.Post()
 
-			if job.canceling {
-				continue
-			}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-			log.Printf("Terminating task: %v", job.task)
-			close(job.cancel)
-			job.canceling = true
+	results := make(chan *tv.Data)
+	var processor *postProcessor
+	if *postProcessFile != "" {
+		config, err := readPostProcessConfig(*postProcessFile)
+		if err != nil {
+			log.Fatalf("readPostProcessConfig failed: %v", err)
 		}
+		processor = newPostProcessor(config, results)
+	}
 
-		for _, task := range tasks {
-			running := false
-			for _, job := range jobs {
-				if task.Equals(job.task) {
-					running = true
-					break
-				}
-			}
-
-			if running {
-				continue
-			}
-
-			runnable := true
-			for _, requirement := range task.Requirements() {
-				if len(resources[requirement]) <= 0 {
-					runnable = false
-				}
-			}
-
-			if !runnable {
-				continue
-			}
-
-			assignments := make([]int32, len(task.Requirements()))
-			for i, requirement := range task.Requirements() {
-				assignments[i] = resources[requirement][len(resources[requirement])-1]
-				resources[requirement] = resources[requirement][0 : len(resources[requirement])-1]
-			}
+	loop := newJobLoop(&systemClock{}, &goroutineRunner{}, source, results, processor)
+	loop.spaceWarning = spaceWarning
+	var nextCleanTime time.Time
 
-			cancel := make(chan struct{})
+	if newData := interruptedPostProcessData(source.Data()); newData != nil {
+		log.Print("Marking the processing interrupted by the last stop failed.")
+		source.Queue(newData)
+	}
 
-			job := &job{
-				task:        task,
-				assignments: assignments,
-				cancel:      cancel,
+	for {
+		now := time.Now()
+		if !now.Before(nextCleanTime) {
+			if _, err := cleanRecordings(source.Data(), now, neededBytes(loop.recordings, now)); err != nil {
+				log.Printf("cleanRecordings failed: %v", err)
 			}
+			nextCleanTime = now.Add(cleanInterval)
+		}
 
-			jobs = append(jobs, job)
+		source.Retry(now)
 
-			log.Printf("Starting task: %v", job.task)
-			go func() {
-				job.task.Run(cancel, assignments)
-				jobDone <- job
-			}()
+		nextTime := loop.Step(ctx)
+		if nextCleanTime.Before(nextTime) {
+			nextTime = nextCleanTime
+		}
+		if retryTime := source.RetryTime(); !retryTime.IsZero() && retryTime.Before(nextTime) {
+			nextTime = retryTime
 		}
 
 		timer := time.NewTimer(nextTime.Sub(time.Now()))
 
 		select {
-		case doneJob := <-jobDone:
-			log.Printf("Task finished: %v", doneJob.task)
+		case doneJob := <-loop.Done():
 			timer.Stop()
-			for i, job := range jobs {
-				if doneJob == job {
-					jobs[i] = jobs[len(jobs)-1]
-					jobs = jobs[0 : len(jobs)-1]
-					break
-				}
-			}
-			for i, requirement := range doneJob.task.Requirements() {
-				resources[requirement] = append(resources[requirement], doneJob.assignments[i])
-			}
+			loop.Finish(doneJob)
 
 		case <-timer.C:
 
 		case <-notificationQueue:
 			log.Print("Notified.")
 			timer.Stop()
-			newData, err := db.FetchData()
-			if err != nil {
-				log.Printf("fetchData failed: %v", err)
-				break
+			source.Fetch()
+
+		case result := <-source.FetchDone():
+			timer.Stop()
+			source.FinishFetch(result)
+
+		case result := <-results:
+			timer.Stop()
+			source.Queue(result)
+
+		case err := <-source.PostDone():
+			timer.Stop()
+			source.FinishPost(err)
+
+		case sig := <-signals:
+			timer.Stop()
+			log.Printf("Received %v, stopping the tasks.", sig)
+			// The states the tasks and the post-processor report
+			// while stopping are cached with the pending data, from
+			// which they are resumed. Nothing reports after they
+			// have exited.
+			loop.Stop()
+
+			// Another signal stops without waiting for the post.
+			source.Post()
+			postTimeout := time.After(shutdownPostTimeout)
+			for source.Posting() {
+				select {
+				case err := <-source.PostDone():
+					source.FinishPost(err)
+					source.Post()
+				case <-postTimeout:
+					log.Print("Stopped before posting all data.")
+					return
+				case sig := <-signals:
+					log.Printf("Received %v, stopped before posting all data.", sig)
+					return
+				}
 			}
-			data = newData
+			log.Print("Stopped.")
+			return
 
 		case command := <-commandQueue:
 			timer.Stop()
 			if command.deleted {
-				delete(commands, command.writer)
+				delete(loop.commands, command.writer)
 			} else {
-				commands[command.writer] = command
+				until, err := playUntil(source.Data(), loop.recordings, loop.commands, command.programNumber, time.Now())
+				if err == nil {
+					loop.commands[command.writer] = command
+				}
+				command.result <- commandResult{until: until, err: err}
 			}
 		}
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -31,17 +33,15 @@ func (task *PlayTask) Equals(otherTask Task) bool {
 	return otherPlayTask.Writer == task.Writer
 }
 
-func (task *PlayTask) Run(cancel <-chan struct{}, assignments []int32) {
+func (task *PlayTask) Run(ctx context.Context, assignments []int32) error {
 	url, err := task.Program.Stream.Url(assignments[0])
 	if err != nil {
-		log.Print("Failed to get a URL")
-		return
+		return err
 	}
 
 	writer, ok := <-task.Writer
 	if !ok {
-		log.Print("Failed to acquire a writer")
-		return
+		return errors.New("Failed to acquire a writer")
 	}
 	defer func() { task.Writer <- writer }()
 
@@ -49,20 +49,23 @@ func (task *PlayTask) Run(cancel <-chan struct{}, assignments []int32) {
 	cmd.Stdout = writer
 	in, err := cmd.StdinPipe()
 	if err != nil {
-		log.Fatal("StdinPipe failed: %v", err)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
 	}
-	cmd.Start()
 
+	var waitErr error
 	waitDone := make(chan struct{})
 	go func() {
-		cmd.Wait()
+		waitErr = cmd.Wait()
 		close(waitDone)
 	}()
 
 	select {
 	case <-waitDone:
-		log.Print("VLC terminated")
-	case <-cancel:
+		return fmt.Errorf("VLC terminated: %v", waitErr)
+	case <-ctx.Done():
 		timer := time.AfterFunc(time.Second, func() {
 			log.Print("VLC is not terminating within a second.")
 			cmd.Process.Kill()
@@ -71,5 +74,6 @@ func (task *PlayTask) Run(cancel <-chan struct{}, assignments []int32) {
 
 		io.WriteString(in, "quit\n")
 		<-waitDone
+		return nil
 	}
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"zng.jp/tv"
+)
+
+// postProcessLogSize is how much of the output of a step is kept in its state.
+const postProcessLogSize = 4096
+
+// postProcessStep is a step of processing a finished recording. It runs
+// Command, or moves the recording and its sidecars into the directory Move or
+// renames them to Rename in the same directory. The arguments, Move and Rename
+// are templates given postProcessArgs.
+type postProcessStep struct {
+	Name    string
+	Command []string
+	Move    string
+	Rename  string
+}
+
+type postProcessConfig struct {
+	// Workers is how many recordings are processed at once.
+	Workers int
+	Steps   []*postProcessStep
+}
+
+type postProcessArgs struct {
+	// File is the recording, which Dir and Base without the extension make
+	// up.
+	File         string
+	Dir          string
+	Base         string
+	Name         string
+	SeriesTitle  string
+	Episode      int
+	ProgramTitle string
+	Start        time.Time
+}
+
+func newPostProcessArgs(event *tv.Event, file string) *postProcessArgs {
+	base := filepath.Base(file)
+	return &postProcessArgs{
+		File:         file,
+		Dir:          filepath.Dir(file),
+		Base:         strings.TrimSuffix(base, filepath.Ext(base)),
+		Name:         event.Info.Name,
+		SeriesTitle:  tv.SeriesTitle(event.Info.Name),
+		Episode:      tv.EpisodeNumber(event),
+		ProgramTitle: event.Program.Info.Title,
+		Start:        event.Info.Start,
+	}
+}
+
+func expand(text string, args *postProcessArgs) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, args); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func readPostProcessConfig(file string) (*postProcessConfig, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	config := &postProcessConfig{}
+	if err := json.NewDecoder(in).Decode(config); err != nil {
+		return nil, err
+	}
+	for _, step := range config.Steps {
+		if len(step.Command) == 0 && step.Move == "" && step.Rename == "" {
+			return nil, errors.New("Step " + step.Name + " does nothing")
+		}
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	return config, nil
+}
+
+// moveFile renames the file, copying it if it is moved to another file system.
+func moveFile(from string, to string) error {
+	err := os.Rename(from, to)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(to)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// moveRecording moves the recording and its sidecars to the given file and
+// returns where the recording is.
+func moveRecording(file string, to string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return "", err
+	}
+	if err := moveFile(file, to); err != nil {
+		return "", err
+	}
+	toBase := strings.TrimSuffix(to, filepath.Ext(to))
+	fromBase := strings.TrimSuffix(file, filepath.Ext(file))
+	for _, ext := range []string{".json", ".nfo"} {
+		if err := moveFile(fromBase+ext, toBase+ext); err != nil && !os.IsNotExist(err) {
+			return to, err
+		}
+	}
+	return to, nil
+}
+
+type postProcessJob struct {
+	id    tv.RecordingId
+	event *tv.Event
+	state tv.RecordingState
+}
+
+// setFiles sets the files of the recording, which are the segments followed by
+// the file.
+func (job *postProcessJob) setFiles(files []string) {
+	job.state.Segments = nil
+	if len(files) > 1 {
+		job.state.Segments = files[0 : len(files)-1]
+	}
+	job.state.File = files[len(files)-1]
+}
+
+// postProcessor runs the steps on finished recordings in its own workers, so
+// that they use no tuners, and reports their states with the recordings. The
+// recordings are processed in the order they are enqueued.
+type postProcessor struct {
+	steps   []*postProcessStep
+	results chan<- *tv.Data
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	mutex   sync.Mutex
+	queued  *sync.Cond
+	queue   []*postProcessJob
+	stopped bool
+}
+
+func newPostProcessor(config *postProcessConfig, results chan<- *tv.Data) *postProcessor {
+	ctx, cancel := context.WithCancel(context.Background())
+	processor := &postProcessor{
+		steps:   config.Steps,
+		results: results,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	processor.queued = sync.NewCond(&processor.mutex)
+	for i := 0; i < config.Workers; i++ {
+		processor.workers.Add(1)
+		go processor.work()
+	}
+	return processor
+}
+
+// Enqueue processes the recording of the event when a worker is free.
+func (processor *postProcessor) Enqueue(event *tv.Event, state *tv.RecordingState) {
+	job := &postProcessJob{
+		id:    event.RecordingId(),
+		event: event,
+		state: *state,
+	}
+	job.state.PostProcess = nil
+	for _, step := range processor.steps {
+		job.state.PostProcess = append(job.state.PostProcess, &tv.PostProcessState{
+			Name:   step.Name,
+			Status: tv.PostProcessPending,
+		})
+	}
+	processor.report(job)
+
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+
+	processor.queue = append(processor.queue, job)
+	processor.queued.Signal()
+}
+
+// Stop kills the commands being run and waits for the workers to exit, which
+// report the steps interrupted as failed. The recordings left in the queue are
+// marked failed when tvworker restarts.
+func (processor *postProcessor) Stop() {
+	processor.mutex.Lock()
+	processor.stopped = true
+	processor.queued.Broadcast()
+	processor.mutex.Unlock()
+
+	processor.cancel()
+	processor.workers.Wait()
+}
+
+func (processor *postProcessor) report(job *postProcessJob) {
+	state := job.state
+	state.PostProcess = nil
+	for _, stepState := range job.state.PostProcess {
+		stepStateCopy := *stepState
+		state.PostProcess = append(state.PostProcess, &stepStateCopy)
+	}
+	data := &tv.Data{}
+	data.InsertRecordingState(job.id, &state)
+	processor.results <- data
+}
+
+func (processor *postProcessor) work() {
+	defer processor.workers.Done()
+	for {
+		processor.mutex.Lock()
+		for len(processor.queue) == 0 && !processor.stopped {
+			processor.queued.Wait()
+		}
+		if processor.stopped {
+			processor.mutex.Unlock()
+			return
+		}
+		job := processor.queue[0]
+		processor.queue = processor.queue[1:]
+		processor.mutex.Unlock()
+
+		processor.process(job)
+	}
+}
+
+func (processor *postProcessor) process(job *postProcessJob) {
+	failed := false
+	for i, step := range processor.steps {
+		stepState := job.state.PostProcess[i]
+		if failed {
+			stepState.Status = tv.PostProcessSkipped
+			continue
+		}
+
+		stepState.Status = tv.PostProcessRunning
+		stepState.Start = time.Now()
+		processor.report(job)
+
+		output, err := processor.runStep(step, job)
+		if err != nil {
+			log.Printf("Step %s failed for %s: %v", step.Name, job.state.File, err)
+			output += err.Error() + "\n"
+			stepState.Status = tv.PostProcessFailed
+			failed = true
+		} else {
+			stepState.Status = tv.PostProcessDone
+		}
+		if len(output) > postProcessLogSize {
+			output = output[len(output)-postProcessLogSize:]
+		}
+		stepState.Log = output
+		stepState.Stop = time.Now()
+	}
+	processor.report(job)
+}
+
+// interruptedPostProcessData returns the states of the recordings whose
+// processing was interrupted by tvworker stopping, marking the steps failed.
+func interruptedPostProcessData(data *tv.Data) *tv.Data {
+	var newData *tv.Data
+	for id, state := range data.RecordingStateMap {
+		interrupted := false
+		for _, stepState := range state.PostProcess {
+			if stepState.Status == tv.PostProcessPending || stepState.Status == tv.PostProcessRunning {
+				interrupted = true
+			}
+		}
+		if !interrupted {
+			continue
+		}
+
+		newState := *state
+		newState.PostProcess = nil
+		for _, stepState := range state.PostProcess {
+			newStepState := *stepState
+			if newStepState.Status == tv.PostProcessPending || newStepState.Status == tv.PostProcessRunning {
+				newStepState.Status = tv.PostProcessFailed
+				newStepState.Log += errSuspended.Error() + "\n"
+			}
+			newState.PostProcess = append(newState.PostProcess, &newStepState)
+		}
+		if newData == nil {
+			newData = &tv.Data{}
+		}
+		newData.InsertRecordingState(id, &newState)
+	}
+	return newData
+}
+
+// runStep runs the step, returning its output and updating the file of the
+// recording if it moves.
+func (processor *postProcessor) runStep(step *postProcessStep, job *postProcessJob) (string, error) {
+	args := newPostProcessArgs(job.event, job.state.File)
+
+	if len(step.Command) != 0 {
+		var commandArgs []string
+		for _, arg := range step.Command {
+			expandedArg, err := expand(arg, args)
+			if err != nil {
+				return "", err
+			}
+			commandArgs = append(commandArgs, expandedArg)
+		}
+		output, err := exec.CommandContext(processor.ctx, commandArgs[0], commandArgs[1:]...).CombinedOutput()
+		return string(output), err
+	}
+
+	var dir, base string
+	if step.Move != "" {
+		var err error
+		if dir, err = expand(step.Move, args); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if base, err = expand(step.Rename, args); err != nil {
+			return "", err
+		}
+		if base != filepath.Base(base) {
+			return "", errors.New("Renaming into another directory: " + base)
+		}
+	}
+
+	// The segments the recording continues from are moved along with
+	// it, and renamed as its continuations.
+	files := append(append([]string(nil), job.state.Segments...), job.state.File)
+	var output string
+	for i, file := range files {
+		var to string
+		if step.Move != "" {
+			to = filepath.Join(dir, filepath.Base(file))
+		} else {
+			to = filepath.Join(args.Dir, base+filepath.Ext(job.state.File))
+			if i != 0 {
+				to = continuationFile(to, i)
+			}
+		}
+		movedFile, err := moveRecording(file, to)
+		if movedFile != "" {
+			files[i] = movedFile
+		}
+		if err != nil {
+			job.setFiles(files)
+			return output, err
+		}
+		output += "Moved to " + movedFile + "\n"
+	}
+	job.setFiles(files)
+	return output, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zng.jp/tv"
+)
+
+func newPostProcessEvent() *tv.Event {
+	return &tv.Event{
+		Info:    &tv.EventInfo{Start: time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC), Duration: time.Hour, Name: "News"},
+		Program: &tv.Program{Info: &tv.ProgramInfo{Number: 101, Title: "NHK BS1"}},
+	}
+}
+
+// lastState returns the last state reported for the recording once all its
+// steps have ended.
+func lastState(t *testing.T, results <-chan *tv.Data) *tv.RecordingState {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case data := <-results:
+			for _, state := range data.RecordingStateMap {
+				ended := true
+				for _, stepState := range state.PostProcess {
+					if stepState.Status == tv.PostProcessPending || stepState.Status == tv.PostProcessRunning {
+						ended = false
+					}
+				}
+				if ended {
+					return state
+				}
+			}
+		case <-timeout:
+			t.Fatal("The recording is not processed")
+		}
+	}
+}
+
+func TestPostProcessRenamesSegments(t *testing.T) {
+	dir := t.TempDir()
+	segment := filepath.Join(dir, "News.ts")
+	file := filepath.Join(dir, "News (2).ts")
+	for _, name := range []string{segment, file} {
+		if err := os.WriteFile(name, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make(chan *tv.Data)
+	processor := newPostProcessor(&postProcessConfig{
+		Workers: 1,
+		Steps:   []*postProcessStep{{Name: "rename", Rename: "{{.Name}} {{.Start.Format \"0102\"}}"}},
+	}, results)
+	defer processor.Stop()
+
+	go processor.Enqueue(newPostProcessEvent(), &tv.RecordingState{File: file, Segments: []string{segment}})
+	state := lastState(t, results)
+	if state.PostProcess[0].Status != tv.PostProcessDone {
+		t.Fatalf("Step %s: %s", state.PostProcess[0].Status, state.PostProcess[0].Log)
+	}
+
+	wantSegment := filepath.Join(dir, "News 1019.ts")
+	wantFile := filepath.Join(dir, "News 1019 (2).ts")
+	if len(state.Segments) != 1 || state.Segments[0] != wantSegment || state.File != wantFile {
+		t.Errorf("Got %v and %s, want %s and %s", state.Segments, state.File, wantSegment, wantFile)
+	}
+	for _, name := range []string{wantSegment, wantFile} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPostProcessStopKillsCommands(t *testing.T) {
+	results := make(chan *tv.Data)
+	processor := newPostProcessor(&postProcessConfig{
+		Workers: 1,
+		Steps:   []*postProcessStep{{Name: "sleep", Command: []string{"sleep", "60"}}},
+	}, results)
+
+	go processor.Enqueue(newPostProcessEvent(), &tv.RecordingState{File: "News.ts"})
+	// The first report is of the pending step, the second of the running
+	// one.
+	<-results
+	<-results
+
+	stopped := make(chan struct{})
+	go func() {
+		processor.Stop()
+		close(stopped)
+	}()
+	state := lastState(t, results)
+	if state.PostProcess[0].Status != tv.PostProcessFailed {
+		t.Errorf("Step %s, want %s", state.PostProcess[0].Status, tv.PostProcessFailed)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop does not return")
+	}
+}
@@ -1,64 +1,379 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"zng.jp/tv"
 )
 
+// RecordTask records events on the services of one transport stream with a
+// single tuner. The capture writes out all the services of the transport
+// stream, so that it keeps running while events on any of them are added, and
+// the events following each other are written to their own files.
 type RecordTask struct {
-	Event *tv.Event
+	Events  []*tv.Event
+	Results chan<- *tv.Data
+	// States are the states of the events reported by earlier runs, which
+	// a restarted capture resumes.
+	States map[tv.RecordingId]*tv.RecordingState
+	// Rules are the rules the events are recorded for.
+	Rules map[tv.RecordingId]*tv.Rule
+	// PostProcessor processes the finished recordings if it is not nil.
+	PostProcessor *postProcessor
+	// Tuner is the tuner the plan assigned to the events.
+	Tuner int32
+
+	mutex     sync.Mutex
+	suspended bool
+	// captured are the services of the running capture.
+	captured []int32
 }
 
-func (task *RecordTask) getFile() string {
-	return "/srv/tv/" + task.Event.Info.Name + ".ts"
+var errSuspended = errors.New("tvworker stopped")
+
+// recordingsDir is where the recordings are written.
+const recordingsDir = "/srv/tv"
+
+// getFile returns the file the event is recorded to, which is named after its
+// start as well so that the airings of a recurring show get their own files.
+// Slashes in the name are replaced and leading dots dropped, so that the file
+// stays in recordingsDir and is served by tvctl.
+func getFile(event *tv.Event) string {
+	name := strings.TrimLeft(strings.ReplaceAll(event.Info.Name, "/", "／"), ".")
+	return filepath.Join(recordingsDir, fmt.Sprintf("%s %s.ts", name, event.Info.Start.Format("2006-01-02 1504")))
 }
 
 func (task *RecordTask) String() string {
-	return fmt.Sprintf("RecordTask{%v %v}", task.Event.Program.Info.Number, task.Event.Info.Name)
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	var events []string
+	for _, event := range task.Events {
+		events = append(events, fmt.Sprintf("%v %v", event.Program.Info.Number, event.Info.Name))
+	}
+	return fmt.Sprintf("RecordTask{%v}", strings.Join(events, ", "))
 }
 
 func (task *RecordTask) Requirements() []int32 {
-	return []int32{task.Event.Program.Stream.Config.System}
+	return []int32{task.Events[0].Program.Stream.Config.System}
+}
+
+func (task *RecordTask) PlannedTuners() []int32 {
+	return []int32{task.Tuner}
+}
+
+type int32s []int32
+
+func (numbers int32s) Len() int {
+	return len(numbers)
+}
+func (numbers int32s) Swap(i, j int) {
+	numbers[i], numbers[j] = numbers[j], numbers[i]
+}
+func (numbers int32s) Less(i, j int) bool {
+	return numbers[i] < numbers[j]
+}
+
+// capturedProgramNumbers returns the services the capture writes out, which are
+// those of the running capture, or those of the transport stream and the
+// events if it has not started.
+func (task *RecordTask) capturedProgramNumbers() []int32 {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	if task.captured != nil {
+		return task.captured
+	}
+
+	var programNumbers []int32
+	seen := make(map[int32]bool)
+	add := func(programNumber int32) {
+		if !seen[programNumber] {
+			seen[programNumber] = true
+			programNumbers = append(programNumbers, programNumber)
+		}
+	}
+	if stream := task.Events[0].Program.Stream; stream.Info != nil {
+		for _, program := range stream.Programs() {
+			add(program.Info.Number)
+		}
+	}
+	for _, event := range task.Events {
+		add(event.Program.Info.Number)
+	}
+	sort.Sort(int32s(programNumbers))
+	return programNumbers
+}
+
+// captures reports whether the capture of the task writes out the services of
+// all the events of the other task.
+func (task *RecordTask) captures(otherTask *RecordTask) bool {
+	captured := make(map[int32]bool)
+	for _, programNumber := range task.capturedProgramNumbers() {
+		captured[programNumber] = true
+	}
+
+	otherTask.mutex.Lock()
+	defer otherTask.mutex.Unlock()
+
+	for _, event := range otherTask.Events {
+		if !captured[event.Program.Info.Number] {
+			return false
+		}
+	}
+	return true
 }
 
+// Equals reports whether the tasks can share a capture, so that a task
+// continues across the events on the services it captures.
 func (task *RecordTask) Equals(otherTask Task) bool {
 	otherRecordTask, ok := otherTask.(*RecordTask)
-	if !ok {
+	if !ok || !otherRecordTask.Events[0].Program.Stream.SharesTransport(task.Events[0].Program.Stream) {
 		return false
 	}
-	return otherRecordTask.Event.Program.Info.Number == task.Event.Program.Info.Number && otherRecordTask.Event.Info.Name == task.Event.Info.Name
+	return task.captures(otherRecordTask) && otherRecordTask.captures(task)
+}
+
+// Update takes the events of an equal task scheduled later.
+func (task *RecordTask) Update(otherTask Task) {
+	otherRecordTask := otherTask.(*RecordTask)
+	events := otherRecordTask.Events
+
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	task.Events = events
+	task.Rules = otherRecordTask.Rules
+}
+
+// eventAt returns the event of the program whose file the capture should be
+// written to, which is the last one started, or the first one if none has
+// started, or nil if the program has no events to record.
+func (task *RecordTask) eventAt(programNumber int32, now time.Time) *tv.Event {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	var firstEvent, lastStartedEvent *tv.Event
+	for _, event := range task.Events {
+		if event.Program.Info.Number != programNumber {
+			continue
+		}
+		if firstEvent == nil || event.Info.Start.Before(firstEvent.Info.Start) {
+			firstEvent = event
+		}
+		if event.Info.Start.After(now) {
+			continue
+		}
+		if lastStartedEvent == nil || event.Info.Start.After(lastStartedEvent.Info.Start) {
+			lastStartedEvent = event
+		}
+	}
+	if lastStartedEvent != nil {
+		return lastStartedEvent
+	}
+	return firstEvent
+}
+
+// previousState returns a copy of the state an earlier run reported for the
+// event, or nil if it has not been captured.
+func (task *RecordTask) previousState(event *tv.Event) *tv.RecordingState {
+	state, ok := task.States[event.RecordingId()]
+	if !ok || state.Status == tv.RecordingScheduled {
+		return nil
+	}
+	previousState := *state
+	previousState.Gaps = append([]tv.RecordingGap{}, state.Gaps...)
+	return &previousState
+}
+
+// report sends the state of the recording of the event, along with the episode
+// of the series it is recorded for once it has completed, so that the other
+// airings of the episode are skipped only if it was recorded in full.
+func (task *RecordTask) report(event *tv.Event, state *tv.RecordingState) {
+	task.mutex.Lock()
+	rule := task.Rules[event.RecordingId()]
+	task.mutex.Unlock()
+	var ruleId tv.RuleId
+	if rule != nil {
+		ruleId = rule.Id
+	}
+	if err := writeSidecars(event, ruleId, state); err != nil {
+		log.Printf("writeSidecars failed: %v", err)
+	}
+
+	data := &tv.Data{}
+	data.InsertRecordingState(event.RecordingId(), state)
+	if rule != nil && state.Status == tv.RecordingCompleted {
+		if id, episode := tv.NewRecordedEpisode(rule, event); episode != nil {
+			data.InsertRecordedEpisode(id, episode)
+		}
+	}
+	task.Results <- data
+}
+
+func (task *RecordTask) finish(event *tv.Event, state *tv.RecordingState) {
+	if task.PostProcessor != nil {
+		task.PostProcessor.Enqueue(event, state)
+	}
+}
+
+// Suspend makes the task stop as if the capture failed when it is cancelled, so
+// that the recordings are neither finished nor processed.
+func (task *RecordTask) Suspend() {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	task.suspended = true
+}
+
+// FailureData returns the states of the started events that the failed run
+// did not capture at all. Those captured have had their states reported.
+func (task *RecordTask) FailureData(data *tv.Data, err error, retryAt time.Time) *tv.Data {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	message := err.Error()
+	if !retryAt.IsZero() {
+		message += fmt.Sprintf("; retrying at %02d:%02d:%02d", retryAt.Hour(), retryAt.Minute(), retryAt.Second())
+	}
+
+	now := time.Now()
+	var newData *tv.Data
+	for _, event := range task.Events {
+		if now.Before(event.Info.Start) {
+			continue
+		}
+		if state := data.RecordingState(event); state != nil && state.Status != tv.RecordingScheduled && state.Status != tv.RecordingFailed {
+			continue
+		}
+		if newData == nil {
+			newData = &tv.Data{}
+		}
+		newData.InsertRecordingState(event.RecordingId(), &tv.RecordingState{
+			Status:        tv.RecordingFailed,
+			ProgramNumber: event.Program.Info.Number,
+			Name:          event.Info.Name,
+			EventStart:    event.Info.Start,
+			Error:         message,
+		})
+	}
+	return newData
 }
 
-func (task *RecordTask) Run(cancel <-chan struct{}, assignments []int32) {
-	url, err := task.Event.Program.Stream.Url(assignments[0])
+func (task *RecordTask) Run(ctx context.Context, assignments []int32) error {
+	url, err := task.Events[0].Program.Stream.Url(assignments[0])
 	if err != nil {
-		log.Print("Failed to get a URL")
-		return
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "tvworker")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// VLC writes each service to a FIFO, which is opened for writing as
+	// well so that it can be read before VLC opens it and until VLC has
+	// finished.
+	programNumbers := task.capturedProgramNumbers()
+	task.mutex.Lock()
+	task.captured = programNumbers
+	task.mutex.Unlock()
+
+	var programs []string
+	var destinations []string
+	var fifos []*os.File
+	defer func() {
+		for _, fifo := range fifos {
+			fifo.Close()
+		}
+	}()
+	for _, programNumber := range programNumbers {
+		path := filepath.Join(dir, fmt.Sprintf("%d.ts", programNumber))
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return err
+		}
+		fifo, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		fifos = append(fifos, fifo)
+		programs = append(programs, strconv.FormatInt(int64(programNumber), 10))
+		destinations = append(destinations, fmt.Sprintf("dst=standard{access=file,mux=ts,dst=%q},select=\"program=%d\"", path, programNumber))
+	}
+
+	var splitters []*tsSplitter
+	var splittersDone sync.WaitGroup
+	for i, programNumber := range programNumbers {
+		splitter := &tsSplitter{
+			programNumber: programNumber,
+			eventAt:       task.eventAt,
+			previousState: task.previousState,
+			report:        task.report,
+			finish:        task.finish,
+		}
+		splitters = append(splitters, splitter)
+		splittersDone.Add(1)
+		go func(fifo *os.File) {
+			defer splittersDone.Done()
+			splitter.Copy(fifo)
+		}(fifos[i])
 	}
 
-	cmd := exec.Command("env", "LANG=C", "vlc", "-I", "rc", "--sout", "#standard{access=file,dst="+task.getFile(), ",mux=ts}", "--no-sout-all", "--programs", strconv.FormatInt(int64(task.Event.Program.Info.Number), 10), url)
+	cmd := exec.Command("env", "LANG=C", "vlc", "-I", "rc", "--sout", "#duplicate{"+strings.Join(destinations, ",")+"}", "--no-sout-all", "--programs", strings.Join(programs, ","), url)
 	in, err := cmd.StdinPipe()
 	if err != nil {
-		log.Fatal("StdinPipe failed: %v", err)
+		return err
 	}
 
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		// The splitters stop at the read deadline of the FIFOs.
+		for _, fifo := range fifos {
+			fifo.SetReadDeadline(time.Now())
+		}
+		splittersDone.Wait()
+		return err
+	}
 
+	var waitErr error
 	waitDone := make(chan struct{})
 	go func() {
-		cmd.Wait()
+		waitErr = cmd.Wait()
+		for _, fifo := range fifos {
+			fifo.SetReadDeadline(time.Now().Add(time.Second))
+		}
 		close(waitDone)
 	}()
 
+	// stopErr is why the capture stopped if it was not cancelled.
+	var stopErr error
 	select {
 	case <-waitDone:
 		log.Print("VLC terminated")
-	case <-cancel:
+		if waitErr != nil {
+			stopErr = fmt.Errorf("VLC terminated: %v", waitErr)
+		} else {
+			stopErr = errors.New("VLC terminated")
+		}
+	case <-ctx.Done():
+		task.mutex.Lock()
+		if task.suspended {
+			stopErr = errSuspended
+		}
+		task.mutex.Unlock()
 		timer := time.AfterFunc(time.Second, func() {
 			log.Print("VLC is not terminating within a second.")
 			cmd.Process.Kill()
@@ -68,4 +383,14 @@ func (task *RecordTask) Run(cancel <-chan struct{}, assignments []int32) {
 		io.WriteString(in, "quit\n")
 		<-waitDone
 	}
+
+	splittersDone.Wait()
+	stop := time.Now()
+	for _, splitter := range splitters {
+		splitter.Finish(stop, stopErr)
+	}
+	if stopErr == errSuspended {
+		return nil
+	}
+	return stopErr
 }
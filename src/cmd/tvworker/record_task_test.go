@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"zng.jp/tv"
+)
+
+func TestRecordTaskEqualsOnTransport(t *testing.T) {
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	data.InsertStreamInfo("00001", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 1024, Title: "NHK G", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "News"},
+		}},
+		{Number: 1025, Title: "NHK G2", Events: []*tv.EventInfo{
+			{Start: start.Add(30 * time.Minute), Duration: time.Hour, Name: "Drama"},
+		}},
+	}})
+	data.InsertStreamInfo("00002", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 1032, Title: "NHK E", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "Science"},
+		}},
+	}})
+	events := make(map[string]*tv.Event)
+	for _, event := range data.Events() {
+		events[event.Info.Name] = event
+	}
+
+	running := &RecordTask{Events: []*tv.Event{events["News"]}}
+	running.captured = running.capturedProgramNumbers()
+
+	joined := &RecordTask{Events: []*tv.Event{events["News"], events["Drama"]}}
+	if !running.Equals(joined) || !joined.Equals(running) {
+		t.Errorf("An event on another service of the transport restarts the capture")
+	}
+
+	other := &RecordTask{Events: []*tv.Event{events["Science"]}}
+	if running.Equals(other) {
+		t.Errorf("An event on another transport joins the capture")
+	}
+}
+
+func TestGetFileStaysInRecordingsDir(t *testing.T) {
+	event := &tv.Event{Info: &tv.EventInfo{Start: time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC), Name: "../News 7/8"}}
+	file := getFile(event)
+	if filepath.Dir(file) != recordingsDir {
+		t.Errorf("getFile = %s, want a file in %s", file, recordingsDir)
+	}
+	if name := filepath.Base(file); name != "／News 7／8 2026-10-19 2100.ts" {
+		t.Errorf("getFile = %s, want the slashes replaced", name)
+	}
+}
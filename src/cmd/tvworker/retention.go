@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"zng.jp/tv"
+)
+
+// cleanInterval is how often recordings are deleted as their rules and the
+// free space floor require.
+const cleanInterval = 10 * time.Minute
+
+// minFreeGB is the free space in gigabytes of 10^9 bytes kept by deleting the
+// oldest recordings not kept forever, which is not done if it is zero.
+var minFreeGB int64
+
+const bytesPerGB = 1000 * 1000 * 1000
+
+// bytesPerSecond estimates the size of the recordings of each system.
+var bytesPerSecond = map[int32]int64{
+	tv.ISDB_T: 17 * 1000 * 1000 / 8,
+	tv.ISDB_S: 24 * 1000 * 1000 / 8,
+}
+
+func projectedSize(event *tv.Event) int64 {
+	return bytesPerSecond[event.Program.Stream.Config.System] * int64(event.Info.Duration/time.Second)
+}
+
+func freeBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func gigabytes(bytes int64) string {
+	return fmt.Sprintf("%.1f GB", float64(bytes)/bytesPerGB)
+}
+
+// neededBytes estimates how much the recordings will write until the next
+// cleaning, for which space is made.
+func neededBytes(recordings []*tv.Recording, now time.Time) int64 {
+	until := now.Add(cleanInterval + playLeadTime)
+	var needed int64
+	for _, recording := range recordings {
+		if recording.Tuner < 0 || recording.Replacement != nil || !recording.Event.Info.Start.Before(until) || !now.Before(recording.End()) {
+			continue
+		}
+		start := recording.Event.Info.Start
+		if start.Before(now) {
+			start = now
+		}
+		needed += bytesPerSecond[recording.Event.Program.Stream.Config.System] * int64(recording.End().Sub(start)/time.Second)
+	}
+	return needed
+}
+
+// inUse reports whether the recording is being written or processed.
+func inUse(data *tv.Data, entry *tv.LibraryEntry) bool {
+	for _, state := range data.RecordingStateMap {
+		if filepath.Base(state.File) != filepath.Base(entry.File) {
+			continue
+		}
+		if state.Status == tv.RecordingRecording {
+			return true
+		}
+		for _, stepState := range state.PostProcess {
+			if stepState.Status == tv.PostProcessPending || stepState.Status == tv.PostProcessRunning {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deleteRecording deletes the recording and its sidecars.
+func deleteRecording(entry *tv.LibraryEntry) error {
+	if err := os.Remove(entry.File); err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(entry.File, filepath.Ext(entry.File))
+	for _, ext := range []string{".json", ".nfo"} {
+		if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanRecordings deletes the recordings expired by their rules, and the
+// oldest ones until needed bytes fit above the free space floor. It returns
+// the free space left.
+func cleanRecordings(data *tv.Data, now time.Time, needed int64) (int64, error) {
+	entries, err := data.ScanLibrary(recordingsDir)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := make(map[string]bool)
+	for _, entry := range data.ExpiredRecordings(entries, now) {
+		if inUse(data, entry) {
+			continue
+		}
+		log.Printf("Deleting expired recording %s", entry.File)
+		if err := deleteRecording(entry); err != nil {
+			log.Printf("deleteRecording failed: %v", err)
+			continue
+		}
+		deleted[entry.File] = true
+	}
+
+	free, err := freeBytes(recordingsDir)
+	if err != nil {
+		return 0, err
+	}
+	if minFreeGB <= 0 {
+		return free, nil
+	}
+	minFree := minFreeGB * bytesPerGB
+	for _, entry := range data.DeletableRecordings(entries) {
+		if free >= minFree+needed {
+			break
+		}
+		if deleted[entry.File] || inUse(data, entry) {
+			continue
+		}
+		log.Printf("Deleting %s to keep %s free", entry.File, gigabytes(minFree))
+		if err := deleteRecording(entry); err != nil {
+			log.Printf("deleteRecording failed: %v", err)
+			continue
+		}
+		if free, err = freeBytes(recordingsDir); err != nil {
+			return 0, err
+		}
+	}
+	return free, nil
+}
+
+// spaceWarning returns a warning if the recording of the event will not fit
+// above the free space floor, which cleanRecordings has made room for by then.
+func spaceWarning(data *tv.Data, event *tv.Event, now time.Time) string {
+	size := projectedSize(event)
+	free, err := freeBytes(recordingsDir)
+	if err != nil {
+		log.Printf("freeBytes failed: %v", err)
+		return ""
+	}
+	if free-minFreeGB*bytesPerGB < size {
+		log.Printf("%s may not fit in %s", event.Info.Name, gigabytes(free))
+		return fmt.Sprintf("Only %s is free for the projected %s", gigabytes(free), gigabytes(size))
+	}
+	return ""
+}
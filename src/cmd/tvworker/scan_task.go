@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,20 +12,20 @@ import (
 	"strconv"
 	"time"
 	"zng.jp/tv"
-	"zng.jp/tv/db"
 )
 
 type ScanTask struct {
-	Time   time.Time
-	Stream *tv.Stream
+	Time    time.Time
+	Stream  *tv.Stream
+	Results chan<- *tv.Data
 }
 
-func sleep(cancel <-chan struct{}, duration time.Duration) bool {
+func sleep(ctx context.Context, duration time.Duration) bool {
 	timer := time.NewTimer(duration)
 	select {
 	case <-timer.C:
 		return true
-	case <-cancel:
+	case <-ctx.Done():
 		timer.Stop()
 		return false
 	}
@@ -118,9 +119,9 @@ func (task *ScanTask) parseStreamInfo(scanner *bufio.Scanner) (*tv.StreamInfo, e
 	return nil, scanner.Err()
 }
 
-func (task *ScanTask) communicate(cancel <-chan struct{}, in io.Writer, scanner *bufio.Scanner) (*tv.StreamInfo, error) {
-	if !sleep(cancel, 300*time.Second) {
-		return nil, errors.New("Cancelled")
+func (task *ScanTask) communicate(ctx context.Context, in io.Writer, scanner *bufio.Scanner) (*tv.StreamInfo, error) {
+	if !sleep(ctx, 300*time.Second) {
+		return nil, ctx.Err()
 	}
 
 	if _, err := io.WriteString(in, "info\n"); err != nil {
@@ -141,7 +142,7 @@ func (task *ScanTask) communicate(cancel <-chan struct{}, in io.Writer, scanner
 	return streamInfo, nil
 }
 
-func (task *ScanTask) scanStreamInfo(cancel <-chan struct{}, assignment int32) (*tv.StreamInfo, error) {
+func (task *ScanTask) scanStreamInfo(ctx context.Context, assignment int32) (*tv.StreamInfo, error) {
 	url, err := task.Stream.Url(assignment)
 	if err != nil {
 		return nil, err
@@ -150,23 +151,26 @@ func (task *ScanTask) scanStreamInfo(cancel <-chan struct{}, assignment int32) (
 	cmd := exec.Command("env", "LANG=C", "vlc", "-I", "oldrc", "--rc-fake-tty", "--no-audio", "--no-video", url)
 	in, err := cmd.StdinPipe()
 	if err != nil {
-		log.Fatal("cmd.StdinPipe failed: %v", err)
+		return nil, err
 	}
 	out, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Fatal("cmd.StdoutPipe failed: %v", err)
+		return nil, err
 	}
 
 	scanner := bufio.NewScanner(out)
 
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
 
-	communicateCancel := make(chan struct{})
+	communicateCtx, communicateCancel := context.WithCancel(ctx)
+	defer communicateCancel()
 	communicateDone := make(chan struct{})
 	var streamInfo *tv.StreamInfo
 	var communicateErr error
 	go func() {
-		streamInfo, communicateErr = task.communicate(communicateCancel, in, scanner)
+		streamInfo, communicateErr = task.communicate(communicateCtx, in, scanner)
 		close(communicateDone)
 	}()
 
@@ -177,12 +181,12 @@ func (task *ScanTask) scanStreamInfo(cancel <-chan struct{}, assignment int32) (
 	}()
 
 	select {
-	case <-cancel:
+	case <-ctx.Done():
 		cmd.Process.Kill()
-		close(communicateCancel)
+		communicateCancel()
 		<-communicateDone
 		<-waitDone
-		return nil, errors.New("Cancelled")
+		return nil, ctx.Err()
 
 	case <-communicateDone:
 		if communicateErr != nil {
@@ -201,7 +205,7 @@ func (task *ScanTask) scanStreamInfo(cancel <-chan struct{}, assignment int32) (
 		return streamInfo, nil
 
 	case <-waitDone:
-		close(communicateCancel)
+		communicateCancel()
 		<-communicateDone
 		if communicateErr != nil {
 			return nil, errors.New("VLC terminated")
@@ -227,7 +231,10 @@ func (task *ScanTask) Equals(otherTask Task) bool {
 	return otherScanTask.Stream.Id == task.Stream.Id
 }
 
-func (task *ScanTask) Run(cancel <-chan struct{}, assignments []int32) {
+// Run records the time of the scan even if it fails, so that the other
+// streams are scanned before it is scanned again at its next time. A failure
+// is not returned, as retrying it would repeat the scan recorded as done.
+func (task *ScanTask) Run(ctx context.Context, assignments []int32) error {
 	data := &tv.Data{
 		StreamStateMap: map[tv.StreamId]*tv.StreamState{
 			task.Stream.Id: &tv.StreamState{
@@ -236,18 +243,21 @@ func (task *ScanTask) Run(cancel <-chan struct{}, assignments []int32) {
 		},
 	}
 
-	streamInfo, err := task.scanStreamInfo(cancel, assignments[0])
+	streamInfo, err := task.scanStreamInfo(ctx, assignments[0])
+	if ctx.Err() != nil {
+		return nil
+	}
 	if err == nil {
 		data.InsertStreamInfo(task.Stream.Id, streamInfo)
-	} else {
-		log.Printf("scanStreamInfo failed: %v", err)
-		if err.Error() == "Cancelled" {
-			return
-		}
 	}
 
-	if err := db.PostData(cancel, data); err != nil {
-		log.Printf("PostData failed: %v", err)
-		return
+	if err != nil {
+		log.Printf("Scan of %s failed: %v", task.Stream.Id, err)
 	}
+
+	select {
+	case task.Results <- data:
+	case <-ctx.Done():
+	}
+	return nil
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"zng.jp/tv"
+)
+
+// writeNfo is whether Kodi .nfo files are written next to recordings as well
+// as the JSON sidecars.
+var writeNfo bool
+
+func newRecordingMetadata(event *tv.Event, ruleId tv.RuleId, state *tv.RecordingState) *tv.RecordingMetadata {
+	info := *event.Info
+	return &tv.RecordingMetadata{
+		Event:         &info,
+		ProgramNumber: event.Program.Info.Number,
+		ProgramTitle:  event.Program.Info.Title,
+		StreamId:      event.Program.Stream.Id,
+		RuleId:        ruleId,
+		CaptureStart:  state.Start,
+		CaptureStop:   state.Stop,
+		Gaps:          state.Gaps,
+		Error:         state.Error,
+	}
+}
+
+// nfoEpisode is the episodedetails element of Kodi.
+type nfoEpisode struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Plot      string   `xml:"plot"`
+	Aired     string   `xml:"aired"`
+	Runtime   int      `xml:"runtime"`
+	Studio    string   `xml:"studio"`
+	Episode   int      `xml:"episode,omitempty"`
+}
+
+func writeNfoFile(file string, event *tv.Event) error {
+	nfoFile := strings.TrimSuffix(file, filepath.Ext(file)) + ".nfo"
+	out, err := os.Create(nfoFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.WriteString(xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(&nfoEpisode{
+		Title:     event.Info.Name,
+		ShowTitle: tv.SeriesTitle(event.Info.Name),
+		Plot:      event.Info.Description,
+		Aired:     event.Info.Start.Format("2006-01-02"),
+		Runtime:   int(event.Info.Duration.Minutes()),
+		Studio:    event.Program.Info.Title,
+		Episode:   tv.EpisodeNumber(event),
+	}); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeSidecars writes the metadata of the recording of the event next to its
+// file.
+func writeSidecars(event *tv.Event, ruleId tv.RuleId, state *tv.RecordingState) error {
+	if err := tv.WriteRecordingMetadata(state.File, newRecordingMetadata(event, ruleId, state)); err != nil {
+		return err
+	}
+	if writeNfo {
+		return writeNfoFile(state.File, event)
+	}
+	return nil
+}
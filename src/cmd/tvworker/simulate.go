@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+	"zng.jp/tv"
+)
+
+// simulatedScanTime is how long a scan takes in the simulation.
+const simulatedScanTime = time.Minute
+
+// simulatedTimerDelay is how late the job loop wakes up in the simulation.
+const simulatedTimerDelay = time.Millisecond
+
+type simulatedClock struct {
+	now time.Time
+}
+
+func (clock *simulatedClock) Now() time.Time {
+	return clock.now
+}
+
+// fileSource holds the data read from a file, into which the data produced in
+// the simulation is merged.
+type fileSource struct {
+	data *tv.Data
+}
+
+func (source *fileSource) Data() *tv.Data {
+	return source.data
+}
+
+func (source *fileSource) Queue(newData *tv.Data) {
+	source.data.MergeData(newData)
+}
+
+type simulatedRun struct {
+	ctx context.Context
+	job *job
+	// end is when the task finishes on its own, or zero if it runs until
+	// it is cancelled.
+	end time.Time
+}
+
+// simulatedRunner runs no tasks but keeps them running until they are
+// cancelled, except the scans, which finish after simulatedScanTime.
+type simulatedRunner struct {
+	clock  *simulatedClock
+	source dataSource
+	runs   []*simulatedRun
+}
+
+func (runner *simulatedRunner) Start(ctx context.Context, job *job, done chan<- *job) {
+	run := &simulatedRun{ctx: ctx, job: job}
+	if _, ok := job.task.(*ScanTask); ok {
+		run.end = runner.clock.now.Add(simulatedScanTime)
+	}
+	runner.runs = append(runner.runs, run)
+}
+
+// Ended returns the jobs that have been cancelled or finished by now, queuing
+// the stream states the finished scans report.
+func (runner *simulatedRunner) Ended() []*job {
+	var jobs []*job
+	var runs []*simulatedRun
+	for _, run := range runner.runs {
+		if run.ctx.Err() != nil {
+			jobs = append(jobs, run.job)
+			continue
+		}
+		if run.end.IsZero() || runner.clock.now.Before(run.end) {
+			runs = append(runs, run)
+			continue
+		}
+		if scanTask, ok := run.job.task.(*ScanTask); ok {
+			data := &tv.Data{}
+			data.InsertStreamState(scanTask.Stream.Id, &tv.StreamState{Time: scanTask.Time})
+			runner.source.Queue(data)
+		}
+		jobs = append(jobs, run.job)
+	}
+	runner.runs = runs
+	return jobs
+}
+
+// Cancelled reports whether a job has been cancelled but not ended yet.
+func (runner *simulatedRunner) Cancelled() bool {
+	for _, run := range runner.runs {
+		if run.ctx.Err() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// NextEnd returns when the next task finishes on its own, or zero if none
+// does.
+func (runner *simulatedRunner) NextEnd() time.Time {
+	var nextEnd time.Time
+	for _, run := range runner.runs {
+		if !run.end.IsZero() && (nextEnd.IsZero() || run.end.Before(nextEnd)) {
+			nextEnd = run.end
+		}
+	}
+	return nextEnd
+}
+
+func readSimulationData(file string) (*tv.Data, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	data := &tv.Data{}
+	if err := json.NewDecoder(in).Decode(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func parseSimulationTimes(fromText string, toText string) (time.Time, time.Time, error) {
+	from := time.Now()
+	if fromText != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, fromText); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	to := from.Add(planHorizon)
+	if toText != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, toText); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	return from, to, nil
+}
+
+// simulate replays the rules and the EPG in the data file from the time from to
+// to against tasks that use no tuners, printing the decisions of the job loop
+// at the simulated times. Nothing is recorded, deleted or posted.
+func simulate(file string, from time.Time, to time.Time) error {
+	data, err := readSimulationData(file)
+	if err != nil {
+		return err
+	}
+
+	source := &fileSource{data: data}
+	clock := &simulatedClock{now: from}
+	runner := &simulatedRunner{clock: clock, source: source}
+	loop := newJobLoop(clock, runner, source, nil, nil)
+
+	log.SetOutput(os.Stdout)
+	log.SetFlags(0)
+	runSimulation(loop, runner, to)
+	log.SetPrefix(to.Format("2006-01-02 15:04:05 "))
+	log.Printf("Simulation ended with %d tasks running.", len(loop.jobs))
+	return nil
+}
+
+// runSimulation steps the loop until the time to, advancing the clock of the
+// runner to the time each step asks to be woken up at.
+func runSimulation(loop *jobLoop, runner *simulatedRunner, to time.Time) {
+	clock := runner.clock
+	ctx := context.Background()
+	for clock.now.Before(to) {
+		log.SetPrefix(clock.now.Format("2006-01-02 15:04:05 "))
+		for _, job := range runner.Ended() {
+			loop.Finish(job)
+		}
+		nextTime := loop.Step(ctx)
+
+		// The jobs cancelled by the step free their tuners for the
+		// tasks waiting for them before the time advances.
+		if runner.Cancelled() {
+			continue
+		}
+
+		if nextEnd := runner.NextEnd(); !nextEnd.IsZero() && nextEnd.Before(nextTime) {
+			nextTime = nextEnd
+		}
+		if nextTime.Before(clock.now) {
+			nextTime = clock.now
+		}
+		// Timers fire after the time they are set to, when the events
+		// starting at it are current.
+		clock.now = nextTime.Add(simulatedTimerDelay)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+	"zng.jp/tv"
+	"zng.jp/tv/db/dbtest"
+)
+
+// useTempDir makes the caches of the test written to a temporary directory.
+func useTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(dir)
+	})
+}
+
+func fetch(t *testing.T, source *tvctlSource) {
+	source.Fetch()
+	source.FinishFetch(<-source.FetchDone())
+}
+
+func post(t *testing.T, source *tvctlSource) {
+	for source.Posting() {
+		err := <-source.PostDone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.FinishPost(err)
+	}
+}
+
+func TestLoopWithServer(t *testing.T) {
+	useTempDir(t)
+	server, err := dbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer server.Install()()
+
+	ctx := context.Background()
+	start := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &tv.Data{}
+	data.InsertStreamInfo("00101", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 101, Title: "NHK BS1", Events: []*tv.EventInfo{
+			{Start: start, Duration: time.Hour, Name: "News"},
+		}},
+	}})
+	data.InsertRuleConfig("news", &tv.RuleConfig{ProgramNumber: 101, Start: start, Duration: time.Hour, Name: "News"})
+	if err := server.Client.PostData(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	source := newTvctlSource(ctx)
+	fetch(t, source)
+	clock := &simulatedClock{now: start.Add(-30 * time.Second)}
+	runner := &simulatedRunner{clock: clock, source: source}
+	loop := newJobLoop(clock, runner, source, nil, nil)
+
+	// The tuner is reserved and the recording reported as scheduled.
+	loop.Step(ctx)
+	post(t, source)
+	serverData, err := server.Client.FetchData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := serverData.Events()[0]
+	if state := serverData.RecordingState(event); state == nil || state.Status != tv.RecordingScheduled {
+		t.Errorf("RecordingState = %+v, want scheduled", state)
+	}
+
+	// The recording starts once the event does.
+	clock.now = start.Add(time.Second)
+	loop.Step(ctx)
+	var recordTask *RecordTask
+	for _, job := range loop.jobs {
+		if task, ok := job.task.(*RecordTask); ok {
+			recordTask = task
+		}
+	}
+	if recordTask == nil || len(recordTask.Events) != 1 || recordTask.Events[0].Info.Name != "News" {
+		t.Errorf("RecordTask = %v, want RecordTask{101 News}", recordTask)
+	}
+}
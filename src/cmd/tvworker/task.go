@@ -1,7 +1,40 @@
 package main
 
+import (
+	"context"
+	"time"
+	"zng.jp/tv"
+)
+
+// A Task uses tuners of the systems it requires. Run does the task with the
+// assigned tuners until it finishes or ctx is done. It returns an error if the
+// task failed on its own, which makes it retried, and nil if it finished or
+// was cancelled.
 type Task interface {
 	Equals(Task) bool
 	Requirements() []int32
-	Run(<-chan struct{}, []int32)
+	Run(ctx context.Context, assignments []int32) error
+}
+
+// An Updater takes over the details of an equal task scheduled later instead
+// of being restarted.
+type Updater interface {
+	Update(Task)
+}
+
+// A Suspender can stop so that its work is resumed when tvworker restarts.
+type Suspender interface {
+	Suspend()
+}
+
+// A FailureReporter tells what its failed run left undone as data to post,
+// given when it is retried or zero if it is not.
+type FailureReporter interface {
+	FailureData(data *tv.Data, err error, retryAt time.Time) *tv.Data
+}
+
+// A TunerPlanner tells the tuners the plan assigned to it for each of its
+// requirements, which it is run on if they are free.
+type TunerPlanner interface {
+	PlannedTuners() []int32
 }
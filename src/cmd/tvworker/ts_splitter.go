@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"zng.jp/tv"
+)
+
+const tsPacketSize = 188
+
+// captureSlack is how late a capture may start and how early it may stop for
+// the recording to count as completed.
+const captureSlack = 30 * time.Second
+
+// tsSplitter copies the transport stream of a program to the files of its
+// events, switching files at the first PAT following an event boundary so
+// that each file starts decodable. The event is looked up only at PATs.
+type tsSplitter struct {
+	programNumber int32
+	eventAt       func(programNumber int32, now time.Time) *tv.Event
+	previousState func(event *tv.Event) *tv.RecordingState
+	report        func(event *tv.Event, state *tv.RecordingState)
+	// finish is called with the recordings that will not be resumed.
+	finish func(event *tv.Event, state *tv.RecordingState)
+
+	event  *tv.Event
+	state  *tv.RecordingState
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func isPat(packet []byte) bool {
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	return pid == 0 && packet[1]&0x40 != 0
+}
+
+func (splitter *tsSplitter) closeFile() {
+	if splitter.file == nil {
+		return
+	}
+	if err := splitter.writer.Flush(); err != nil {
+		log.Printf("Flush failed: %v", err)
+		splitter.state.Error = err.Error()
+	}
+	if err := splitter.file.Close(); err != nil {
+		log.Printf("Close failed: %v", err)
+		splitter.state.Error = err.Error()
+	}
+	splitter.file = nil
+	splitter.writer = nil
+}
+
+// Finish reports how the recording of the current event went, given when the
+// capture stopped and why if it stopped on its own.
+func (splitter *tsSplitter) Finish(stop time.Time, err error) {
+	if splitter.event == nil {
+		return
+	}
+	splitter.closeFile()
+
+	event := splitter.event
+	state := splitter.state
+	state.Stop = stop
+	if err != nil {
+		state.Error = err.Error()
+	}
+	switch {
+	case state.Bytes == 0:
+		state.Status = tv.RecordingFailed
+	case state.Error != "" || len(state.Gaps) != 0 || state.Start.After(event.Info.Start.Add(captureSlack)) || stop.Before(event.End().Add(-captureSlack)):
+		state.Status = tv.RecordingPartial
+	default:
+		state.Status = tv.RecordingCompleted
+	}
+	log.Printf("Recording %s %s: %s", event.Info.Name, state.Status, state.Error)
+	splitter.report(event, state)
+	// A capture failing before the event ends is retried.
+	if state.Bytes != 0 && (err == nil || !stop.Before(event.End().Add(-captureSlack))) {
+		splitter.finish(event, state)
+	}
+
+	splitter.event = nil
+	splitter.state = nil
+}
+
+// continuationFile returns the file the recording in the given file continues
+// in after the given number of segments.
+func continuationFile(file string, segments int) string {
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(file, ext), segments+1, ext)
+}
+
+func (splitter *tsSplitter) switchEvent(event *tv.Event) {
+	now := time.Now()
+	splitter.Finish(now, nil)
+
+	splitter.event = event
+	// A file is appended to only by the capture resuming it, and otherwise
+	// replaces whatever was left in it.
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if state := splitter.previousState(event); state != nil {
+		// The capture is resumed by appending to the file, leaving a gap
+		// since it last stopped.
+		gapStart := state.Stop
+		if gapStart.IsZero() {
+			if info, err := os.Stat(state.File); err == nil {
+				gapStart = info.ModTime()
+			}
+		}
+		if !gapStart.IsZero() {
+			state.Gaps = append(state.Gaps, tv.RecordingGap{Start: gapStart, Stop: now})
+		}
+		// A capture of an earlier tvworker is continued in a new file
+		// rather than after whatever it left in the file.
+		if state.Stop.IsZero() || state.Stop.Before(startTime) {
+			state.Segments = append(state.Segments, state.File)
+			state.File = continuationFile(getFile(event), len(state.Segments))
+		} else {
+			flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		log.Printf("Resuming the recording of %s with %d gaps", event.Info.Name, len(state.Gaps))
+		state.Status = tv.RecordingRecording
+		state.Stop = time.Time{}
+		splitter.state = state
+	} else {
+		splitter.state = &tv.RecordingState{
+			Status:        tv.RecordingRecording,
+			ProgramNumber: event.Program.Info.Number,
+			Name:          event.Info.Name,
+			EventStart:    event.Info.Start,
+			File:          getFile(event),
+			Start:         now,
+		}
+	}
+
+	file, err := os.OpenFile(splitter.state.File, flag, 0666)
+	if err != nil {
+		log.Printf("OpenFile failed: %v", err)
+		splitter.state.Error = err.Error()
+	} else {
+		log.Printf("Recording to %s", file.Name())
+		splitter.file = file
+		splitter.writer = bufio.NewWriterSize(file, 256*tsPacketSize)
+	}
+	state := *splitter.state
+	splitter.report(event, &state)
+}
+
+// Copy reads packets until the reader fails, which is when the capture ends.
+func (splitter *tsSplitter) Copy(reader io.Reader) {
+	bufferedReader := bufio.NewReaderSize(reader, 256*tsPacketSize)
+	for {
+		packet, err := bufferedReader.Peek(tsPacketSize)
+		if err != nil {
+			return
+		}
+		if packet[0] != 0x47 {
+			bufferedReader.Discard(1)
+			continue
+		}
+
+		if isPat(packet) {
+			event := splitter.eventAt(splitter.programNumber, time.Now())
+			if event == nil {
+				// The service has no events to record.
+				splitter.Finish(time.Now(), nil)
+			} else if splitter.event == nil || event.RecordingId() != splitter.event.RecordingId() {
+				splitter.switchEvent(event)
+			}
+		}
+		if splitter.file != nil {
+			if _, err := splitter.writer.Write(packet); err != nil {
+				log.Printf("Write failed: %v", err)
+				splitter.state.Error = err.Error()
+				splitter.closeFile()
+			} else {
+				splitter.state.Bytes += tsPacketSize
+			}
+		}
+		bufferedReader.Discard(tsPacketSize)
+	}
+}
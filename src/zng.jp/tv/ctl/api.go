@@ -0,0 +1,567 @@
+package ctl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+type apiError struct {
+	Status int
+	Error  string
+}
+
+type eventResource struct {
+	Id            tv.EventId
+	ProgramId     tv.ProgramId
+	ProgramNumber int32
+	ProgramTitle  string
+	StreamId      tv.StreamId
+	Start         timepkg.Time
+	Duration      timepkg.Duration
+	Name          string
+	Description   string
+	RuleId        tv.RuleId `json:",omitempty"`
+}
+
+type programResource struct {
+	Id     tv.ProgramId
+	Number int32
+	Title  string
+}
+
+type streamResource struct {
+	Id       tv.StreamId
+	Config   *tv.StreamConfig
+	State    *tv.StreamState
+	InfoTime *timepkg.Time `json:",omitempty"`
+	Programs []*programResource
+}
+
+type recordingResource struct {
+	Event       *eventResource
+	RuleId      tv.RuleId
+	Priority    int32
+	Tuner       string
+	PreemptedAt *timepkg.Time `json:",omitempty"`
+	Reason      string        `json:",omitempty"`
+}
+
+type conflictResource struct {
+	Start    timepkg.Time
+	End      timepkg.Time
+	Tuners   int
+	EventIds []tv.EventId
+}
+
+type libraryEntryResource struct {
+	Name          string
+	Url           string
+	Size          int64
+	Start         timepkg.Time
+	Duration      timepkg.Duration
+	ProgramNumber int32                 `json:",omitempty"`
+	ProgramTitle  string                `json:",omitempty"`
+	Metadata      *tv.RecordingMetadata `json:",omitempty"`
+}
+
+type planResource struct {
+	Recordings []*recordingResource
+	Conflicts  []*conflictResource
+}
+
+func newEventResource(data *tv.Data, event *tv.Event) *eventResource {
+	resource := &eventResource{
+		Id:            event.Id(),
+		ProgramId:     event.Program.Id(),
+		ProgramNumber: event.Program.Info.Number,
+		ProgramTitle:  event.Program.Info.Title,
+		StreamId:      event.Program.Stream.Id,
+		Start:         event.Info.Start,
+		Duration:      event.Info.Duration,
+		Name:          event.Info.Name,
+		Description:   event.Info.Description,
+	}
+	if rule := data.RuleMatchingEvent(event); rule != nil {
+		resource.RuleId = rule.Id
+	}
+	return resource
+}
+
+func newRecordingResource(data *tv.Data, recording *tv.Recording) *recordingResource {
+	resource := &recordingResource{
+		Event:    newEventResource(data, recording.Event),
+		RuleId:   recording.Rule.Id,
+		Priority: recording.Rule.Config.Priority,
+		Tuner:    recording.TunerName(),
+		Reason:   recording.Reason(),
+	}
+	if !recording.PreemptedAt.IsZero() {
+		resource.PreemptedAt = &recording.PreemptedAt
+	}
+	return resource
+}
+
+func newConflictResource(conflict *tv.Conflict) *conflictResource {
+	resource := &conflictResource{
+		Start:    conflict.Start,
+		End:      conflict.End,
+		Tuners:   conflict.Tuners(),
+		EventIds: []tv.EventId{},
+	}
+	for _, event := range conflict.Events {
+		resource.EventIds = append(resource.EventIds, event.Id())
+	}
+	return resource
+}
+
+func newLibraryEntryResource(entry *tv.LibraryEntry) *libraryEntryResource {
+	resource := &libraryEntryResource{
+		Name:         entry.Name(),
+		Url:          apiRecordingUrl(entry.File),
+		Size:         entry.Size,
+		Start:        entry.Start(),
+		Duration:     entry.Duration(),
+		ProgramTitle: entry.ProgramTitle(),
+		Metadata:     entry.Metadata,
+	}
+	if entry.Metadata != nil {
+		resource.ProgramNumber = entry.Metadata.ProgramNumber
+	}
+	return resource
+}
+
+func newStreamResource(stream *tv.Stream) *streamResource {
+	resource := &streamResource{
+		Id:       stream.Id,
+		Config:   stream.Config,
+		State:    stream.State,
+		Programs: []*programResource{},
+	}
+	if stream.Info != nil {
+		resource.InfoTime = &stream.Info.Time
+		for _, program := range stream.Programs() {
+			resource.Programs = append(resource.Programs, &programResource{
+				Id:     program.Id(),
+				Number: program.Info.Number,
+				Title:  program.Info.Title,
+			})
+		}
+	}
+	return resource
+}
+
+type rulesById []*tv.Rule
+
+func (rules rulesById) Len() int {
+	return len(rules)
+}
+
+func (rules rulesById) Less(i, j int) bool {
+	return rules[i].Id < rules[j].Id
+}
+
+func (rules rulesById) Swap(i, j int) {
+	rules[i], rules[j] = rules[j], rules[i]
+}
+
+type eventResourcesByStart []*eventResource
+
+func (events eventResourcesByStart) Len() int {
+	return len(events)
+}
+
+func (events eventResourcesByStart) Less(i, j int) bool {
+	if !events[i].Start.Equal(events[j].Start) {
+		return events[i].Start.Before(events[j].Start)
+	}
+	return events[i].ProgramNumber < events[j].ProgramNumber
+}
+
+func (events eventResourcesByStart) Swap(i, j int) {
+	events[i], events[j] = events[j], events[i]
+}
+
+type streamResourcesById []*streamResource
+
+func (streams streamResourcesById) Len() int {
+	return len(streams)
+}
+
+func (streams streamResourcesById) Less(i, j int) bool {
+	return streams[i].Id < streams[j].Id
+}
+
+func (streams streamResourcesById) Swap(i, j int) {
+	streams[i], streams[j] = streams[j], streams[i]
+}
+
+// apiPath returns the part of the request path following "/api/", which is
+// preceded by the script name when running as a CGI.
+func apiPath(request *http.Request) (string, bool) {
+	path := request.URL.Path
+	if scriptName := os.Getenv("SCRIPT_NAME"); scriptName != "" {
+		if !strings.HasPrefix(path, scriptName) {
+			return "", false
+		}
+		path = path[len(scriptName):]
+	}
+	if path == "/api" {
+		return "", true
+	}
+	if !strings.HasPrefix(path, "/api/") {
+		return "", false
+	}
+	return strings.TrimSuffix(path[len("/api/"):], "/"), true
+}
+
+// apiRecordingUrl returns the absolute path of the page playing the recording
+// in the given file, which clients of the API cannot resolve relative to it.
+func apiRecordingUrl(file string) string {
+	return os.Getenv("SCRIPT_NAME") + "/?mode=recording&name=" + url.QueryEscape(filepath.Base(file))
+}
+
+func writeJson(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Printf("Encode failed: %v", err)
+	}
+}
+
+func writeJsonError(writer http.ResponseWriter, status int, message string) {
+	writeJson(writer, status, &apiError{
+		Status: status,
+		Error:  message,
+	})
+}
+
+func newRuleId() (tv.RuleId, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return tv.RuleId(hex.EncodeToString(buf)), nil
+}
+
+func decodeRuleConfig(request *http.Request) (*tv.RuleConfig, error) {
+	if request.Body == nil {
+		return nil, errors.New("Request body is nil")
+	}
+
+	config := &tv.RuleConfig{}
+	if err := json.NewDecoder(request.Body).Decode(config); err != nil {
+		return nil, err
+	}
+	if config.Deleted {
+		return nil, errors.New("Use DELETE to delete a rule")
+	}
+	if config.ProgramNumber == 0 {
+		return nil, errors.New("ProgramNumber is required")
+	}
+	if err := checkManualRule(config); err != nil {
+		return nil, err
+	}
+	for _, weekday := range config.Weekdays {
+		if weekday < timepkg.Sunday || weekday > timepkg.Saturday {
+			return nil, errors.New("Invalid weekday: " + strconv.Itoa(int(weekday)))
+		}
+	}
+	return config, nil
+}
+
+func parseApiTime(str string) (timepkg.Time, error) {
+	if str == "" {
+		return timepkg.Time{}, nil
+	}
+	return timepkg.Parse(timepkg.RFC3339, str)
+}
+
+func (handler *Handler) processApiRules(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET", "HEAD":
+		data, err := handler.storage.readData()
+		if err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rules := data.Rules()
+		sort.Sort(rulesById(rules))
+		if rules == nil {
+			rules = []*tv.Rule{}
+		}
+		writeJson(writer, http.StatusOK, rules)
+
+	case "POST":
+		config, err := decodeRuleConfig(request)
+		if err != nil {
+			writeJsonError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		id, err := newRuleId()
+		if err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		newData := &tv.Data{}
+		newData.InsertRuleConfig(id, config)
+		if err := handler.storage.writeData(newData); err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writer.Header().Set("Location", "rules/"+string(id))
+		writeJson(writer, http.StatusCreated, &tv.Rule{Id: id, Config: config})
+
+	default:
+		writeJsonError(writer, http.StatusMethodNotAllowed, "Method "+request.Method+" not allowed")
+	}
+}
+
+func (handler *Handler) processApiRule(writer http.ResponseWriter, request *http.Request, id tv.RuleId) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	config := data.RuleConfigMap[id]
+
+	switch request.Method {
+	case "GET", "HEAD":
+		if config == nil {
+			writeJsonError(writer, http.StatusNotFound, "Rule not found: "+string(id))
+			return
+		}
+		writeJson(writer, http.StatusOK, &tv.Rule{Id: id, Config: config})
+
+	case "PUT":
+		newConfig, err := decodeRuleConfig(request)
+		if err != nil {
+			writeJsonError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		newData := &tv.Data{}
+		newData.InsertRuleConfig(id, newConfig)
+		if err := handler.storage.writeData(newData); err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		status := http.StatusOK
+		if config == nil {
+			status = http.StatusCreated
+		}
+		writeJson(writer, status, &tv.Rule{Id: id, Config: newConfig})
+
+	case "DELETE":
+		if config == nil {
+			writeJsonError(writer, http.StatusNotFound, "Rule not found: "+string(id))
+			return
+		}
+
+		newData := &tv.Data{}
+		newData.InsertRuleConfig(id, &tv.RuleConfig{Deleted: true})
+		if err := handler.storage.writeData(newData); err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJsonError(writer, http.StatusMethodNotAllowed, "Method "+request.Method+" not allowed")
+	}
+}
+
+func (handler *Handler) processApiEvents(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	from, err := parseApiTime(query.Get("from"))
+	if err != nil {
+		writeJsonError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	to, err := parseApiTime(query.Get("to"))
+	if err != nil {
+		writeJsonError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var programNumber int64
+	if programNumberStr := query.Get("program"); programNumberStr != "" {
+		programNumber, err = strconv.ParseInt(programNumberStr, 10, 32)
+		if err != nil {
+			writeJsonError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events := []*eventResource{}
+	for _, event := range data.Events() {
+		if event.Info == nil {
+			continue
+		}
+		if !from.IsZero() && !from.Before(event.End()) {
+			continue
+		}
+		if !to.IsZero() && !event.Info.Start.Before(to) {
+			continue
+		}
+		if programNumber != 0 && int64(event.Program.Info.Number) != programNumber {
+			continue
+		}
+		events = append(events, newEventResource(data, event))
+	}
+	sort.Sort(eventResourcesByStart(events))
+
+	writeJson(writer, http.StatusOK, events)
+}
+
+func (handler *Handler) processApiEvent(writer http.ResponseWriter, request *http.Request, id tv.EventId) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event := data.FindEvent(id)
+	if event == nil {
+		writeJsonError(writer, http.StatusNotFound, "Event not found: "+string(id))
+		return
+	}
+
+	writeJson(writer, http.StatusOK, newEventResource(data, event))
+}
+
+func (handler *Handler) processApiStreams(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	streams := []*streamResource{}
+	for _, stream := range data.Streams() {
+		streams = append(streams, newStreamResource(stream))
+	}
+	sort.Sort(streamResourcesById(streams))
+
+	writeJson(writer, http.StatusOK, streams)
+}
+
+func (handler *Handler) processApiPlan(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	from, err := parseApiTime(query.Get("from"))
+	if err != nil {
+		writeJsonError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if from.IsZero() {
+		from = timepkg.Now()
+	}
+
+	to, err := parseApiTime(query.Get("to"))
+	if err != nil {
+		writeJsonError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if to.IsZero() {
+		to = from.Add(24 * timepkg.Hour)
+	}
+
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	recordings, conflicts := data.PlanRecordings(from, to)
+	plan := &planResource{
+		Recordings: []*recordingResource{},
+		Conflicts:  []*conflictResource{},
+	}
+	for _, recording := range recordings {
+		plan.Recordings = append(plan.Recordings, newRecordingResource(data, recording))
+	}
+	for _, conflict := range conflicts {
+		plan.Conflicts = append(plan.Conflicts, newConflictResource(conflict))
+	}
+
+	writeJson(writer, http.StatusOK, plan)
+}
+
+func (handler *Handler) processApiRecordings(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		writeJsonError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var entries []*tv.LibraryEntry
+	if handler.RecordingsDir != "" {
+		entries, err = data.ScanLibrary(handler.RecordingsDir)
+		if err != nil {
+			writeJsonError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	search := request.URL.Query().Get("search")
+	recordings := []*libraryEntryResource{}
+	for _, entry := range entries {
+		if search == "" || entry.Matches(search) {
+			recordings = append(recordings, newLibraryEntryResource(entry))
+		}
+	}
+
+	writeJson(writer, http.StatusOK, recordings)
+}
+
+func (handler *Handler) processApi(writer http.ResponseWriter, request *http.Request, path string) {
+	segments := strings.Split(path, "/")
+	readOnly := request.Method == "GET" || request.Method == "HEAD"
+
+	switch {
+	case len(segments) == 1 && segments[0] == "rules":
+		handler.processApiRules(writer, request)
+	case len(segments) == 2 && segments[0] == "rules":
+		handler.processApiRule(writer, request, tv.RuleId(segments[1]))
+	case len(segments) == 1 && segments[0] == "events" && readOnly:
+		handler.processApiEvents(writer, request)
+	case len(segments) == 2 && segments[0] == "events" && readOnly:
+		handler.processApiEvent(writer, request, tv.EventId(segments[1]))
+	case len(segments) == 1 && segments[0] == "streams" && readOnly:
+		handler.processApiStreams(writer, request)
+	case len(segments) == 1 && segments[0] == "plan" && readOnly:
+		handler.processApiPlan(writer, request)
+	case len(segments) == 1 && segments[0] == "recordings" && readOnly:
+		handler.processApiRecordings(writer, request)
+	case len(segments) <= 2 && (segments[0] == "events" || segments[0] == "streams" || segments[0] == "plan" || segments[0] == "recordings"):
+		writeJsonError(writer, http.StatusMethodNotAllowed, "Method "+request.Method+" not allowed")
+	default:
+		writeJsonError(writer, http.StatusNotFound, "Unknown resource: "+path)
+	}
+}
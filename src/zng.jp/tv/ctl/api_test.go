@@ -0,0 +1,191 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+// serveApi sends the request to the handler and decodes the JSON response into
+// value if it is not nil.
+func serveApi(t *testing.T, handler *Handler, method string, path string, body string, value interface{}) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if value != nil {
+		if err := json.NewDecoder(recorder.Body).Decode(value); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return recorder
+}
+
+func TestApiRules(t *testing.T) {
+	handler := NewHandler(t.TempDir(), Assets)
+
+	rule := &tv.Rule{}
+	recorder := serveApi(t, handler, "POST", "/api/rules", `{"ProgramNumber": 101, "Name": "News"}`, rule)
+	if recorder.Code != http.StatusCreated || rule.Id == "" || rule.Config.Name != "News" {
+		t.Fatalf("POST returned %d and %+v, want the created rule", recorder.Code, rule)
+	}
+	if location := recorder.Header().Get("Location"); location != "rules/"+string(rule.Id) {
+		t.Errorf("Location = %s, want rules/%s", location, rule.Id)
+	}
+
+	path := "/api/rules/" + string(rule.Id)
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", path, "", http.StatusOK},
+		{"PUT", path, `{"ProgramNumber": 101, "Name": "News", "Priority": 5}`, http.StatusOK},
+		{"PUT", "/api/rules/drama", `{"ProgramNumber": 101, "Name": "Drama"}`, http.StatusCreated},
+		{"DELETE", path, "", http.StatusNoContent},
+		{"GET", path, "", http.StatusNotFound},
+		{"DELETE", path, "", http.StatusNotFound},
+		{"PATCH", "/api/rules/drama", "", http.StatusMethodNotAllowed},
+		{"PATCH", "/api/rules", "", http.StatusMethodNotAllowed},
+	} {
+		if recorder := serveApi(t, handler, test.method, test.path, test.body, nil); recorder.Code != test.status {
+			t.Errorf("%s %s returned %d, want %d", test.method, test.path, recorder.Code, test.status)
+		}
+	}
+
+	var rules []*tv.Rule
+	serveApi(t, handler, "GET", "/api/rules", "", &rules)
+	if len(rules) != 1 || rules[0].Id != "drama" {
+		t.Errorf("GET returned %d rules, want the one put", len(rules))
+	}
+}
+
+func TestApiRuleErrors(t *testing.T) {
+	handler := NewHandler(t.TempDir(), Assets)
+
+	for _, body := range []string{
+		`{"ProgramNumber": `,
+		`{"Name": "News"}`,
+		`{"ProgramNumber": 101, "Deleted": true}`,
+		`{"ProgramNumber": 101, "Weekdays": [7]}`,
+	} {
+		apiErr := &apiError{}
+		recorder := serveApi(t, handler, "POST", "/api/rules", body, apiErr)
+		if recorder.Code != http.StatusBadRequest || apiErr.Status != http.StatusBadRequest || apiErr.Error == "" {
+			t.Errorf("Posting %s returned %d and %+v, want a bad request", body, recorder.Code, apiErr)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("Posting %s returned %s, want JSON", body, contentType)
+		}
+	}
+}
+
+func TestApiRouting(t *testing.T) {
+	handler := NewHandler(t.TempDir(), Assets)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/api/streams", http.StatusOK},
+		{"GET", "/api/events/", http.StatusOK},
+		{"POST", "/api/events", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/events/00101", http.StatusMethodNotAllowed},
+		{"PUT", "/api/plan", http.StatusMethodNotAllowed},
+		{"GET", "/api/events/unknown", http.StatusNotFound},
+		{"GET", "/api/channels", http.StatusNotFound},
+		{"GET", "/api/rules/news/airings", http.StatusNotFound},
+	} {
+		apiErr := &apiError{}
+		recorder := serveApi(t, handler, test.method, test.path, "", nil)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s returned %d, want %d", test.method, test.path, recorder.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusOK {
+			continue
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(apiErr); err != nil || apiErr.Status != test.status {
+			t.Errorf("%s %s returned %+v, want a JSON error", test.method, test.path, apiErr)
+		}
+	}
+}
+
+func TestApiEvents(t *testing.T) {
+	start := timepkg.Date(2026, 10, 19, 21, 0, 0, 0, timepkg.UTC)
+	handler := NewHandler(t.TempDir(), Assets)
+	data := &tv.Data{}
+	data.InsertStreamInfo("00101", &tv.StreamInfo{Time: start, Programs: []*tv.ProgramInfo{
+		{Number: 101, Title: "NHK BS1", Events: []*tv.EventInfo{
+			{Start: start, Duration: timepkg.Hour, Name: "News"},
+			{Start: start.Add(timepkg.Hour), Duration: timepkg.Hour, Name: "Drama"},
+		}},
+		{Number: 102, Title: "NHK BS2", Events: []*tv.EventInfo{
+			{Start: start, Duration: 2 * timepkg.Hour, Name: "Film"},
+		}},
+	}})
+	if err := handler.storage.writeData(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"News", "Film", "Drama"}},
+		{"?program=101", []string{"News", "Drama"}},
+		// The events in progress at from are included.
+		{"?from=2026-10-19T21:30:00Z", []string{"News", "Film", "Drama"}},
+		{"?from=2026-10-19T22:00:00Z", []string{"Film", "Drama"}},
+		{"?to=2026-10-19T22:00:00Z", []string{"News", "Film"}},
+		{"?from=2026-10-19T22:00:00Z&to=2026-10-19T23:00:00Z&program=101", []string{"Drama"}},
+	} {
+		var events []*eventResource
+		serveApi(t, handler, "GET", "/api/events"+test.query, "", &events)
+		var names []string
+		for _, event := range events {
+			names = append(names, event.Name)
+		}
+		// Events starting together have no defined order.
+		if len(names) != len(test.names) || names[len(names)-1] != test.names[len(test.names)-1] {
+			t.Errorf("GET events%s returned %v, want %v", test.query, names, test.names)
+		}
+	}
+
+	for _, query := range []string{"?from=yesterday", "?to=2026-10-19", "?program=BS1"} {
+		if recorder := serveApi(t, handler, "GET", "/api/events"+query, "", nil); recorder.Code != http.StatusBadRequest {
+			t.Errorf("GET events%s returned %d, want %d", query, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestApiRecordingsUrl(t *testing.T) {
+	t.Setenv("SCRIPT_NAME", "/tv/tvctl.cgi")
+	handler := NewHandler(t.TempDir(), Assets)
+	handler.RecordingsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(handler.RecordingsDir, "News #1.ts"), []byte("ts"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var recordings []*libraryEntryResource
+	serveApi(t, handler, "GET", "/tv/tvctl.cgi/api/recordings", "", &recordings)
+	if len(recordings) != 1 {
+		t.Fatalf("GET returned %d recordings, want 1", len(recordings))
+	}
+	wantUrl := "/tv/tvctl.cgi/?mode=recording&name=News+%231.ts"
+	if recordings[0].Url != wantUrl {
+		t.Errorf("Url = %s, want %s", recordings[0].Url, wantUrl)
+	}
+
+	// The URL is served by the pages rather than the API.
+	recorder := serveApi(t, handler, "GET", wantUrl, "", nil)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ts" {
+		t.Errorf("GET %s returned %d, want the recording", wantUrl, recorder.Code)
+	}
+}
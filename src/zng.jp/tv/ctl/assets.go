@@ -0,0 +1,81 @@
+package ctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	timepkg "time"
+)
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+// Assets holds the templates and static files compiled into the binary.
+var Assets fs.FS
+
+func init() {
+	var err error
+	Assets, err = fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (handler *Handler) assetVersion(name string) (string, error) {
+	content, err := fs.ReadFile(handler.assets, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func (handler *Handler) assetUrl(name string) (string, error) {
+	version, err := handler.assetVersion(name)
+	if err != nil {
+		return "", err
+	}
+	return "./?mode=asset&name=" + url.QueryEscape(name) + "&v=" + version, nil
+}
+
+func (handler *Handler) parseTemplate(name string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{
+		"asset":        handler.assetUrl,
+		"recordingUrl": recordingUrl,
+	}).ParseFS(handler.assets, name)
+}
+
+func (handler *Handler) processGetAsset(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	name := query.Get("name")
+	if !fs.ValidPath(name) || strings.HasSuffix(name, ".tmpl") {
+		http.NotFound(writer, request)
+		return
+	}
+
+	content, err := fs.ReadFile(handler.assets, name)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+
+	version, err := handler.assetVersion(name)
+	if err != nil {
+		log.Printf("assetVersion failed: %v", err)
+	}
+	if version != "" && query.Get("v") == version {
+		writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		writer.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(writer, request, path.Base(name), timepkg.Time{}, bytes.NewReader(content))
+}
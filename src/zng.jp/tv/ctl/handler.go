@@ -0,0 +1,332 @@
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+func (handler *Handler) processGetJson(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(writer).Encode(data); err != nil {
+		log.Printf("Encode failed: %v", err)
+		return
+	}
+}
+
+func (handler *Handler) processGetEventStream(writer http.ResponseWriter, request *http.Request) {
+	listenCancel := make(chan struct{})
+	defer close(listenCancel)
+
+	notificationQueue := make(chan struct{})
+	var listenErr error
+	go func() {
+		defer close(notificationQueue)
+		if err := handler.storage.listenData(listenCancel, notificationQueue); err != nil {
+			listenErr = err
+			return
+		}
+	}()
+
+	writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+
+	var closeDone <-chan bool
+	if closeNotifier, ok := writer.(http.CloseNotifier); ok {
+		closeDone = closeNotifier.CloseNotify()
+	}
+
+	for {
+		timer := timepkg.NewTimer(timepkg.Second * 10)
+		defer timer.Stop()
+
+		select {
+		case _, ok := <-notificationQueue:
+			if !ok {
+				if listenErr != nil {
+					log.Printf("Listen failed: %v", listenErr)
+				}
+				return
+			}
+			if _, err := io.WriteString(writer, "data: ok\n\n"); err != nil {
+				log.Printf("WriteString failed: %v", err)
+				return
+			}
+		case <-timer.C:
+			if _, err := io.WriteString(writer, "\n"); err != nil {
+				log.Printf("WriteString failed: %v", err)
+				return
+			}
+		case <-closeDone:
+			return
+		case <-request.Context().Done():
+			return
+		}
+
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+func (handler *Handler) processGetHtml(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := handler.renderIndex(data, request.URL.Query(), writer); err != nil {
+		log.Printf("Render failed: %v", err)
+		return
+	}
+}
+
+func (handler *Handler) processGetRules(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := handler.renderRules(data, request.URL.Query(), writer); err != nil {
+		log.Printf("Render failed: %v", err)
+		return
+	}
+}
+
+func (handler *Handler) processGetUpcoming(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := handler.renderUpcoming(data, writer); err != nil {
+		log.Printf("Render failed: %v", err)
+		return
+	}
+}
+
+func (handler *Handler) processGetLibrary(writer http.ResponseWriter, request *http.Request) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := handler.renderLibrary(data, request.URL.Query(), writer); err != nil {
+		log.Printf("Render failed: %v", err)
+		return
+	}
+}
+
+// processGetRecording streams a recording, supporting Range requests so that
+// players can seek.
+func (handler *Handler) processGetRecording(writer http.ResponseWriter, request *http.Request) {
+	name := request.URL.Query().Get("name")
+	if handler.RecordingsDir == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".ts" {
+		http.NotFound(writer, request)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(handler.RecordingsDir, name))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(writer, request, name, info.ModTime(), file)
+}
+
+func (handler *Handler) processGet(writer http.ResponseWriter, request *http.Request) {
+	url := request.URL
+	query := url.Query()
+	mode := query.Get("mode")
+	switch mode {
+	case "json":
+		handler.processGetJson(writer, request)
+	case "event-stream":
+		handler.processGetEventStream(writer, request)
+	case "html":
+		handler.processGetHtml(writer, request)
+	case "rules":
+		handler.processGetRules(writer, request)
+	case "upcoming":
+		handler.processGetUpcoming(writer, request)
+	case "library":
+		handler.processGetLibrary(writer, request)
+	case "recording":
+		handler.processGetRecording(writer, request)
+	case "asset":
+		handler.processGetAsset(writer, request)
+	default:
+		http.Error(writer, "Unknown mode: "+mode, http.StatusBadRequest)
+	}
+}
+
+func (handler *Handler) processPostJson(writer http.ResponseWriter, request *http.Request) {
+	if request.Body == nil {
+		http.Error(writer, "Request body is nil", http.StatusInternalServerError)
+		return
+	}
+
+	newData := &tv.Data{}
+	if err := json.NewDecoder(request.Body).Decode(newData); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := handler.storage.writeData(newData); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// parseRulePost parses a form posted to change a rule or to skip one of its
+// airings, given by skip. The airings skipped by the rule it replaces stay
+// skipped, as the forms do not carry them.
+func (handler *Handler) parseRulePost(values url.Values) (*tv.Data, error) {
+	data, err := handler.storage.readData()
+	if err != nil {
+		return nil, err
+	}
+	id := tv.RuleId(values.Get("id"))
+	oldConfig := data.RuleConfigMap[id]
+
+	if skip := values.Get("skip"); skip != "" {
+		if oldConfig == nil {
+			return nil, errors.New("Rule not found: " + string(id))
+		}
+		config := *oldConfig
+		config.Skipped = append(append([]tv.RecordingId(nil), oldConfig.Skipped...), tv.RecordingId(skip))
+		newData := &tv.Data{}
+		newData.InsertRuleConfig(id, &config)
+		return newData, nil
+	}
+
+	newData, err := parseRuleConfig(values)
+	if err != nil {
+		return nil, err
+	}
+	if oldConfig != nil {
+		for _, config := range newData.RuleConfigMap {
+			if !config.Deleted {
+				config.Skipped = oldConfig.Skipped
+			}
+		}
+	}
+	return newData, nil
+}
+
+func (handler *Handler) processPostHtml(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newData, err := handler.parseRulePost(request.PostForm)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := handler.storage.writeData(newData); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(writer, request, request.URL.String(), http.StatusSeeOther)
+}
+
+func (handler *Handler) processPost(writer http.ResponseWriter, request *http.Request) {
+	url := request.URL
+	query := url.Query()
+	mode := query.Get("mode")
+	switch mode {
+	case "json":
+		handler.processPostJson(writer, request)
+	case "html", "rules", "upcoming":
+		handler.processPostHtml(writer, request)
+	default:
+		http.Error(writer, "Unknown mode: "+mode, http.StatusBadRequest)
+	}
+}
+
+type Handler struct {
+	// RecordingsDir is the directory of the recordings listed in the
+	// library and streamed from it, which is empty if there is none.
+	RecordingsDir string
+
+	storage storage
+	assets  fs.FS
+}
+
+// NewHandler returns a handler serving the data stored in dataDir and the
+// pages rendered from the templates and static files in assets, which is
+// usually Assets.
+func NewHandler(dataDir string, assets fs.FS) *Handler {
+	return &Handler{
+		storage: &fileStorage{dir: dataDir},
+		assets:  assets,
+	}
+}
+
+// NewMemoryHandler is like NewHandler but keeps the data in memory, which
+// suits a long-running server. Writes through the handler are still saved in
+// dataDir, but changes made to dataDir by others are not noticed.
+func NewMemoryHandler(dataDir string, assets fs.FS) (*Handler, error) {
+	storage, err := newMemoryStorage(&fileStorage{dir: dataDir})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handler{
+		storage: storage,
+		assets:  assets,
+	}, nil
+}
+
+func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if path, ok := apiPath(request); ok {
+		handler.processApi(writer, request, path)
+	} else if request.Method == "GET" || request.Method == "HEAD" {
+		handler.processGet(writer, request)
+	} else if request.Method == "POST" {
+		handler.processPost(writer, request)
+	} else {
+		http.Error(writer, "Method "+request.Method+" not allowed", http.StatusMethodNotAllowed)
+	}
+}
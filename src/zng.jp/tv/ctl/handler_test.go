@@ -0,0 +1,25 @@
+package ctl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostJson(t *testing.T) {
+	handler := NewHandler(t.TempDir(), Assets)
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"RuleConfigMap": {"news": {"Name": "News"}}}`, http.StatusNoContent},
+		{`{"RuleConfigMap": `, http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/?mode=json", strings.NewReader(test.body)))
+		if recorder.Code != test.status {
+			t.Errorf("Posting %s returned %d, want %d", test.body, recorder.Code, test.status)
+		}
+	}
+}
@@ -1,7 +1,6 @@
-package main
+package ctl
 
 import (
-	"html/template"
 	"io"
 	"net/url"
 	"sort"
@@ -9,10 +8,6 @@ import (
 	"zng.jp/tv"
 )
 
-var (
-	indexTemplate = template.Must(template.ParseFiles("assets/index.tmpl"))
-)
-
 type time struct {
 	Index           int
 	Time            timepkg.Time
@@ -78,9 +73,10 @@ type indexTemplateArgs struct {
 	Days            []timepkg.Time
 	ExpandDays      bool
 	SelectedEventId tv.EventId
+	Recordings      map[tv.EventId]*tv.Recording
 }
 
-func renderIndex(data *tv.Data, query url.Values, writer io.Writer) error {
+func (handler *Handler) renderIndex(data *tv.Data, query url.Values, writer io.Writer) error {
 	now := timepkg.Now()
 
 	var selectedTime timepkg.Time
@@ -219,6 +215,12 @@ func renderIndex(data *tv.Data, query url.Values, writer io.Writer) error {
 		days = append(days, timepkg.Date(now.Year(), now.Month(), now.Day()+dayOffset, 0, 0, 0, 0, now.Location()))
 	}
 
+	recordings, _ := data.PlanRecordings(now, now.Add(7*24*timepkg.Hour))
+	recordingMap := make(map[tv.EventId]*tv.Recording)
+	for _, recording := range recordings {
+		recordingMap[recording.Event.Id()] = recording
+	}
+
 	args := &indexTemplateArgs{
 		Data:            data,
 		Programs:        programs,
@@ -227,6 +229,12 @@ func renderIndex(data *tv.Data, query url.Values, writer io.Writer) error {
 		Days:            days,
 		ExpandDays:      expandDays,
 		SelectedEventId: selectedEventId,
+		Recordings:      recordingMap,
+	}
+
+	indexTemplate, err := handler.parseTemplate("index.tmpl")
+	if err != nil {
+		return err
 	}
 
 	return indexTemplate.Execute(writer, args)
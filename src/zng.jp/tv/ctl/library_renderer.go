@@ -0,0 +1,101 @@
+package ctl
+
+import (
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"zng.jp/tv"
+)
+
+type libraryGroup struct {
+	Title   string
+	Entries []*tv.LibraryEntry
+}
+
+type libraryGroupsByTitle []*libraryGroup
+
+func (groups libraryGroupsByTitle) Len() int {
+	return len(groups)
+}
+
+func (groups libraryGroupsByTitle) Less(i, j int) bool {
+	return groups[i].Title < groups[j].Title
+}
+
+func (groups libraryGroupsByTitle) Swap(i, j int) {
+	groups[i], groups[j] = groups[j], groups[i]
+}
+
+type libraryTemplateArgs struct {
+	Groups  []*libraryGroup
+	Search  string
+	GroupBy string
+}
+
+// recordingUrl returns the URL streaming the recording in the given file.
+func recordingUrl(file string) string {
+	return "./?mode=recording&name=" + url.QueryEscape(filepath.Base(file))
+}
+
+func libraryGroupTitle(entry *tv.LibraryEntry, groupBy string) string {
+	switch groupBy {
+	case "channel":
+		if title := entry.ProgramTitle(); title != "" {
+			return title
+		}
+		return "Unknown channel"
+	case "series":
+		return entry.SeriesTitle()
+	default:
+		return entry.Start().Format("2006-01-02 Mon")
+	}
+}
+
+func (handler *Handler) renderLibrary(data *tv.Data, query url.Values, writer io.Writer) error {
+	var entries []*tv.LibraryEntry
+	if handler.RecordingsDir != "" {
+		var err error
+		entries, err = data.ScanLibrary(handler.RecordingsDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	search := query.Get("search")
+	groupBy := query.Get("group")
+	if groupBy != "channel" && groupBy != "series" {
+		groupBy = "date"
+	}
+
+	// Entries come latest first, which orders the groups by date.
+	var groups []*libraryGroup
+	groupMap := make(map[string]*libraryGroup)
+	for _, entry := range entries {
+		if search != "" && !entry.Matches(search) {
+			continue
+		}
+		title := libraryGroupTitle(entry, groupBy)
+		group, ok := groupMap[title]
+		if !ok {
+			group = &libraryGroup{Title: title}
+			groupMap[title] = group
+			groups = append(groups, group)
+		}
+		group.Entries = append(group.Entries, entry)
+	}
+	if groupBy != "date" {
+		sort.Sort(libraryGroupsByTitle(groups))
+	}
+
+	libraryTemplate, err := handler.parseTemplate("library.tmpl")
+	if err != nil {
+		return err
+	}
+
+	return libraryTemplate.Execute(writer, &libraryTemplateArgs{
+		Groups:  groups,
+		Search:  search,
+		GroupBy: groupBy,
+	})
+}
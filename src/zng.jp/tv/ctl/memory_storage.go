@@ -0,0 +1,98 @@
+package ctl
+
+import (
+	"errors"
+	"sync"
+	"zng.jp/tv"
+)
+
+// memoryStorage keeps the data in memory for a long-running server, writing
+// it through to a fileStorage and broadcasting changes to the listeners. It
+// is the only writer of the file while it runs.
+//
+// The entries of the data are shared between the copies handed out and never
+// modified in place; writes replace them.
+type memoryStorage struct {
+	file *fileStorage
+
+	mutex     sync.Mutex
+	data      *tv.Data
+	listeners map[chan struct{}]struct{}
+}
+
+func newMemoryStorage(file *fileStorage) (*memoryStorage, error) {
+	data, err := file.readData()
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryStorage{
+		file:      file,
+		data:      data,
+		listeners: make(map[chan struct{}]struct{}),
+	}, nil
+}
+
+func (storage *memoryStorage) readData() (*tv.Data, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return copyData(storage.data), nil
+}
+
+// copyData returns data whose maps can be modified without affecting the
+// original.
+func copyData(data *tv.Data) *tv.Data {
+	newData := &tv.Data{}
+	newData.MergeData(data)
+	return newData
+}
+
+func (storage *memoryStorage) writeData(newData *tv.Data) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	data := copyData(storage.data)
+	data.MergeData(newData)
+	if err := storage.file.replaceData(data); err != nil {
+		return err
+	}
+	storage.data = data
+
+	for listener := range storage.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (storage *memoryStorage) listenData(cancel <-chan struct{}, notificationQueue chan<- struct{}) error {
+	listener := make(chan struct{}, 1)
+
+	storage.mutex.Lock()
+	storage.listeners[listener] = struct{}{}
+	storage.mutex.Unlock()
+
+	defer func() {
+		storage.mutex.Lock()
+		delete(storage.listeners, listener)
+		storage.mutex.Unlock()
+	}()
+
+	listener <- struct{}{}
+
+	for {
+		select {
+		case <-listener:
+			select {
+			case notificationQueue <- struct{}{}:
+			case <-cancel:
+				return errors.New("Cancelled")
+			}
+		case <-cancel:
+			return errors.New("Cancelled")
+		}
+	}
+}
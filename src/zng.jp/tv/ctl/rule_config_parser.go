@@ -0,0 +1,214 @@
+package ctl
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+func parseRuleConfig(values url.Values) (*tv.Data, error) {
+	id := values.Get("id")
+	if id == "" {
+		newId, err := newRuleId()
+		if err != nil {
+			return nil, err
+		}
+		id = string(newId)
+	}
+
+	deleted := values.Get("deleted") != ""
+
+	var programNumber int64
+	programNumberStr := values.Get("program-number")
+	if programNumberStr != "" {
+		var err error
+		programNumber, err = strconv.ParseInt(programNumberStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var start timepkg.Time
+	startStr := values.Get("start")
+	if startStr != "" {
+		var err error
+		start, err = timepkg.Parse("2006-01-02 15:04:05.999999999 -0700 MST", startStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// start-local and until are the values of datetime-local and date
+	// inputs, which have no time zone. The zone is loaded only for them,
+	// from the copy embedded in tvctl if the system has none.
+	var location *timepkg.Location
+	var err error
+	if values.Get("start-local") != "" || values.Get("until") != "" {
+		location, err = timepkg.LoadLocation("Asia/Tokyo")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if startLocalStr := values.Get("start-local"); startLocalStr != "" {
+		start, err = timepkg.ParseInLocation("2006-01-02T15:04", startLocalStr, location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var duration timepkg.Duration
+	durationStr := values.Get("duration")
+	if durationStr != "" {
+		var err error
+		duration, err = timepkg.ParseDuration(durationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name := values.Get("name")
+
+	weekly := values.Get("weekly") != ""
+
+	daily := values.Get("daily") != ""
+
+	var weekdays []timepkg.Weekday
+	for _, weekdayStr := range values["weekday"] {
+		weekday, err := strconv.Atoi(weekdayStr)
+		if err != nil {
+			return nil, err
+		}
+		if weekday < int(timepkg.Sunday) || weekday > int(timepkg.Saturday) {
+			return nil, errors.New("Invalid weekday: " + weekdayStr)
+		}
+		weekdays = append(weekdays, timepkg.Weekday(weekday))
+	}
+
+	var intervalWeeks int64
+	intervalWeeksStr := values.Get("interval-weeks")
+	if intervalWeeksStr != "" {
+		intervalWeeks, err = strconv.ParseInt(intervalWeeksStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var tolerance timepkg.Duration
+	toleranceStr := values.Get("tolerance")
+	if toleranceStr != "" {
+		tolerance, err = timepkg.ParseDuration(toleranceStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// until is the last day an airing may start on.
+	var until timepkg.Time
+	untilStr := values.Get("until")
+	if untilStr != "" {
+		until, err = timepkg.ParseInLocation("2006-01-02", untilStr, location)
+		if err != nil {
+			return nil, err
+		}
+		until = until.AddDate(0, 0, 1).Add(-timepkg.Nanosecond)
+	}
+
+	var count int64
+	countStr := values.Get("count")
+	if countStr != "" {
+		count, err = strconv.ParseInt(countStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manual := values.Get("manual") != ""
+
+	series := values.Get("series") != ""
+
+	streamId := tv.StreamId(values.Get("stream-id"))
+
+	disabled := values.Get("disabled") != ""
+
+	var priority int64
+	priorityStr := values.Get("priority")
+	if priorityStr != "" {
+		var err error
+		priority, err = strconv.ParseInt(priorityStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	preempt := values.Get("preempt") != ""
+
+	var keepEpisodes int64
+	keepEpisodesStr := values.Get("keep-episodes")
+	if keepEpisodesStr != "" {
+		keepEpisodes, err = strconv.ParseInt(keepEpisodesStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keepDays int64
+	keepDaysStr := values.Get("keep-days")
+	if keepDaysStr != "" {
+		keepDays, err = strconv.ParseInt(keepDaysStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keepForever := values.Get("keep-forever") != ""
+
+	reason := values.Get("reason")
+
+	config := &tv.RuleConfig{
+		Deleted:       deleted,
+		Disabled:      disabled,
+		ProgramNumber: int32(programNumber),
+		Start:         start,
+		Duration:      duration,
+		Name:          name,
+		Weekly:        weekly,
+		Daily:         daily,
+		Weekdays:      weekdays,
+		IntervalWeeks: int32(intervalWeeks),
+		Tolerance:     tolerance,
+		Until:         until,
+		Count:         int32(count),
+		Series:        series,
+		Manual:        manual,
+		StreamId:      streamId,
+		Priority:      int32(priority),
+		Preempt:       preempt,
+		KeepEpisodes:  int32(keepEpisodes),
+		KeepDays:      int32(keepDays),
+		KeepForever:   keepForever,
+		Reason:        reason,
+	}
+	if !deleted {
+		if err := checkManualRule(config); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tv.Data{
+		RuleConfigMap: map[tv.RuleId]*tv.RuleConfig{
+			tv.RuleId(id): config,
+		},
+	}, nil
+}
+
+// checkManualRule rejects a manual rule that lacks the stream, the start or
+// the duration it is recorded by, as it has no events to take them from.
+func checkManualRule(config *tv.RuleConfig) error {
+	if config.Manual && (config.StreamId == "" || config.Start.IsZero() || config.Duration <= 0) {
+		return errors.New("StreamId, Start and Duration are required for a manual rule")
+	}
+	return nil
+}
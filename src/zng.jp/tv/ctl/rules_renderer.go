@@ -0,0 +1,111 @@
+package ctl
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+type ruleRow struct {
+	Rule             *tv.Rule
+	Program          *tv.Program
+	NextEvent        *tv.Event
+	LastEvent        *tv.Event
+	RecordedEpisodes []*tv.RecordedEpisode
+}
+
+type ruleRowsByProgramAsc []*ruleRow
+
+func (rows ruleRowsByProgramAsc) Len() int {
+	return len(rows)
+}
+
+func (rows ruleRowsByProgramAsc) Less(i, j int) bool {
+	if rows[i].Rule.Config.ProgramNumber != rows[j].Rule.Config.ProgramNumber {
+		return rows[i].Rule.Config.ProgramNumber < rows[j].Rule.Config.ProgramNumber
+	}
+	return rows[i].Rule.Config.Start.Before(rows[j].Rule.Config.Start)
+}
+
+func (rows ruleRowsByProgramAsc) Swap(i, j int) {
+	rows[i], rows[j] = rows[j], rows[i]
+}
+
+type streamsById []*tv.Stream
+
+func (streams streamsById) Len() int {
+	return len(streams)
+}
+
+func (streams streamsById) Less(i, j int) bool {
+	return streams[i].Id < streams[j].Id
+}
+
+func (streams streamsById) Swap(i, j int) {
+	streams[i], streams[j] = streams[j], streams[i]
+}
+
+type rulesTemplateArgs struct {
+	Now          timepkg.Time
+	Rows         []*ruleRow
+	Programs     []*tv.Program
+	Streams      []*tv.Stream
+	Weekdays     []timepkg.Weekday
+	EditedRuleId tv.RuleId
+}
+
+func (handler *Handler) renderRules(data *tv.Data, query url.Values, writer io.Writer) error {
+	now := timepkg.Now()
+
+	var rows []*ruleRow
+	for _, rule := range data.Rules() {
+		if rule.Config == nil {
+			continue
+		}
+
+		row := &ruleRow{
+			Rule:             rule,
+			Program:          data.FindProgram(rule.Config.ProgramNumber),
+			RecordedEpisodes: data.RecordedEpisodes(rule),
+		}
+		events := data.EventsMatchingRule(rule)
+		if rule.Config.Manual {
+			events = data.ManualEvents(rule, now.AddDate(0, 0, -8), now.AddDate(0, 0, 8))
+		}
+		for _, event := range events {
+			if now.Before(event.End()) {
+				if row.NextEvent == nil || event.Info.Start.Before(row.NextEvent.Info.Start) {
+					row.NextEvent = event
+				}
+			} else {
+				if row.LastEvent == nil || row.LastEvent.Info.Start.Before(event.Info.Start) {
+					row.LastEvent = event
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Sort(ruleRowsByProgramAsc(rows))
+
+	programs := data.Programs()
+	sort.Sort(programsByNumberAsc(programs))
+
+	streams := data.Streams()
+	sort.Sort(streamsById(streams))
+
+	rulesTemplate, err := handler.parseTemplate("rules.tmpl")
+	if err != nil {
+		return err
+	}
+
+	return rulesTemplate.Execute(writer, &rulesTemplateArgs{
+		Now:          now,
+		Rows:         rows,
+		Programs:     programs,
+		Streams:      streams,
+		Weekdays:     []timepkg.Weekday{timepkg.Sunday, timepkg.Monday, timepkg.Tuesday, timepkg.Wednesday, timepkg.Thursday, timepkg.Friday, timepkg.Saturday},
+		EditedRuleId: tv.RuleId(query.Get("edit")),
+	})
+}
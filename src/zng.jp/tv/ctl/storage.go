@@ -0,0 +1,158 @@
+package ctl
+
+import (
+	"encoding/gob"
+	"errors"
+	"golang.org/x/exp/inotify"
+	"os"
+	"path/filepath"
+	"syscall"
+	"zng.jp/tv"
+)
+
+type storage interface {
+	readData() (*tv.Data, error)
+	writeData(newData *tv.Data) error
+	listenData(cancel <-chan struct{}, notificationQueue chan<- struct{}) error
+}
+
+type fileStorage struct {
+	dir string
+}
+
+func (storage *fileStorage) file(name string) string {
+	return filepath.Join(storage.dir, name)
+}
+
+func (storage *fileStorage) readData() (*tv.Data, error) {
+	data := &tv.Data{}
+
+	in, err := os.Open(storage.file("tvctl.gob"))
+	if err == nil {
+		defer in.Close()
+		if err := gob.NewDecoder(in).Decode(data); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (storage *fileStorage) writeData(newData *tv.Data) error {
+	_, err := storage.mergeData(newData)
+	return err
+}
+
+// lock takes the lock serializing the writers of the file, returning the
+// descriptor to close to release it.
+func (storage *fileStorage) lock() (int, error) {
+	lock, err := syscall.Open(storage.file("tvctl.lock"), syscall.O_WRONLY|syscall.O_CREAT|syscall.O_APPEND, 0666)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := syscall.Flock(lock, syscall.LOCK_EX); err != nil {
+		syscall.Close(lock)
+		return -1, err
+	}
+	return lock, nil
+}
+
+// save replaces the file with the data. The caller holds the lock.
+func (storage *fileStorage) save(data *tv.Data) error {
+	out, err := os.Create(storage.file("tvctl.gob.tmp"))
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(out).Encode(data); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(storage.file("tvctl.gob.tmp"), storage.file("tvctl.gob"))
+}
+
+func (storage *fileStorage) mergeData(newData *tv.Data) (*tv.Data, error) {
+	lock, err := storage.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(lock)
+
+	data, err := storage.readData()
+	if err != nil {
+		return nil, err
+	}
+
+	data.MergeData(newData)
+
+	if err := storage.save(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// replaceData replaces the data in the file without reading it.
+func (storage *fileStorage) replaceData(data *tv.Data) error {
+	lock, err := storage.lock()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(lock)
+
+	return storage.save(data)
+}
+
+func (storage *fileStorage) listenData(cancel <-chan struct{}, notificationQueue chan<- struct{}) error {
+	watcher, err := inotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = watcher.AddWatch(storage.dir, inotify.IN_MOVED_TO)
+	if err != nil {
+		return err
+	}
+
+	// The request may have ended by the time a notification is sent,
+	// which would leave a long-running server with this blocked forever.
+	notify := func() error {
+		select {
+		case notificationQueue <- struct{}{}:
+			return nil
+		case <-cancel:
+			return errors.New("Cancelled")
+		}
+	}
+
+	if err := notify(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event := <-watcher.Event:
+			if event.Name == storage.file("tvctl.gob") {
+				if err := notify(); err != nil {
+					return err
+				}
+			}
+		case err := <-watcher.Error:
+			return err
+		case <-cancel:
+			return errors.New("Cancelled")
+		}
+	}
+}
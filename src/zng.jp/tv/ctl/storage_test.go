@@ -0,0 +1,31 @@
+package ctl
+
+import (
+	"testing"
+	timepkg "time"
+)
+
+func TestListenDataReturnsWhenCancelled(t *testing.T) {
+	fileStorage := &fileStorage{dir: t.TempDir()}
+	memoryStorage, err := newMemoryStorage(fileStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range []storage{fileStorage, memoryStorage} {
+		// Nothing receives the notifications, as when the request has
+		// ended.
+		cancel := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- storage.listenData(cancel, make(chan struct{}))
+		}()
+		close(cancel)
+
+		select {
+		case <-done:
+		case <-timepkg.After(10 * timepkg.Second):
+			t.Fatalf("listenData of %T does not return", storage)
+		}
+	}
+}
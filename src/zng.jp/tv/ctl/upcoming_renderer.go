@@ -0,0 +1,46 @@
+package ctl
+
+import (
+	"io"
+	timepkg "time"
+	"zng.jp/tv"
+)
+
+type upcomingRow struct {
+	Recording   *tv.Recording
+	Conflicting bool
+}
+
+type upcomingTemplateArgs struct {
+	Data      *tv.Data
+	Rows      []*upcomingRow
+	Conflicts []*tv.Conflict
+}
+
+func (handler *Handler) renderUpcoming(data *tv.Data, writer io.Writer) error {
+	now := timepkg.Now()
+	recordings, conflicts := data.PlanRecordings(now, now.Add(7*24*timepkg.Hour))
+
+	var rows []*upcomingRow
+	for _, recording := range recordings {
+		row := &upcomingRow{Recording: recording}
+		for _, conflict := range conflicts {
+			if conflict.Contains(recording.Event) {
+				row.Conflicting = true
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	upcomingTemplate, err := handler.parseTemplate("upcoming.tmpl")
+	if err != nil {
+		return err
+	}
+
+	return upcomingTemplate.Execute(writer, &upcomingTemplateArgs{
+		Data:      data,
+		Rows:      rows,
+		Conflicts: conflicts,
+	})
+}
@@ -16,6 +16,17 @@ type EventId string
 type ProgramId string
 type StreamId string
 type RuleId string
+type EpisodeId string
+type RecordingId string
+type RecordingStatus string
+
+const (
+	RecordingScheduled RecordingStatus = "scheduled"
+	RecordingRecording RecordingStatus = "recording"
+	RecordingCompleted RecordingStatus = "completed"
+	RecordingFailed    RecordingStatus = "failed"
+	RecordingPartial   RecordingStatus = "partial"
+)
 
 type StreamConfig struct {
 	System    int32
@@ -25,11 +36,56 @@ type StreamConfig struct {
 
 type RuleConfig struct {
 	Deleted       bool
+	Disabled      bool
 	ProgramNumber int32
 	Start         time.Time
 	Duration      time.Duration
 	Name          string
-	Weekly        bool
+	// Weekly and Daily match the time of Start every week or every day.
+	Weekly bool
+	Daily  bool
+	// Weekdays matches the time of Start on the given days, overriding
+	// Weekly and Daily.
+	Weekdays []time.Weekday
+	// IntervalWeeks makes a recurring rule match only every that many
+	// weeks, counted from the week of Start.
+	IntervalWeeks int32
+	// Tolerance is how far the start of a matched event may be from the
+	// time of Start.
+	Tolerance time.Duration
+	// Until and Count end a recurring rule after the given time or number
+	// of airings if not zero.
+	Until time.Time
+	Count int32
+	// Series matches the events on the program whose names are Name apart
+	// from markers and episode numbers, skipping episodes already
+	// recorded.
+	Series bool
+	// Manual records from Start for Duration on the program of the stream
+	// with StreamId, whether or not the EPG has events there.
+	Manual   bool
+	StreamId StreamId
+	// Priority decides which recordings get tuners when more matched
+	// events overlap than there are tuners. Higher values win.
+	Priority int32
+	// Preempt allows interrupting recordings of lower priority in progress
+	// when no tuner is free.
+	Preempt bool
+	// KeepEpisodes and KeepDays delete the recordings of the rule beyond
+	// the latest that many or older than that many days if not zero.
+	// KeepForever never deletes them, even to free disk space.
+	KeepEpisodes int32
+	KeepDays     int32
+	KeepForever  bool
+	// Reason explains why the rule was created by tvworker rather than
+	// the user, such as for recording a rebroadcast.
+	Reason string
+	// OriginalRuleId is the rule whose airing a rule made for recording a
+	// rebroadcast replaces, whose retention the recordings follow.
+	OriginalRuleId RuleId
+	// Skipped lists the recordings of matched events that are not to be
+	// made, such as a single airing of a weekly rule.
+	Skipped []RecordingId
 }
 
 type StreamState struct {
@@ -54,10 +110,70 @@ type StreamInfo struct {
 	Programs []*ProgramInfo
 }
 
+// RecordedEpisode is an episode recorded for a series rule.
+type RecordedEpisode struct {
+	RuleId RuleId
+	Key    string
+	Start  time.Time
+	Name   string
+}
+
+type PostProcessStatus string
+
+const (
+	PostProcessPending PostProcessStatus = "pending"
+	PostProcessRunning PostProcessStatus = "running"
+	PostProcessDone    PostProcessStatus = "done"
+	PostProcessFailed  PostProcessStatus = "failed"
+	PostProcessSkipped PostProcessStatus = "skipped"
+)
+
+// PostProcessState is how a step processing a finished recording went.
+type PostProcessState struct {
+	Name   string
+	Status PostProcessStatus
+	Start  time.Time
+	Stop   time.Time
+	// Log is the end of the output of the step.
+	Log string
+}
+
+// RecordingGap is when the capture of a recording was interrupted.
+type RecordingGap struct {
+	Start time.Time
+	Stop  time.Time
+}
+
+// RecordingState is what tvworker reports about recording an event.
+type RecordingState struct {
+	Status        RecordingStatus
+	ProgramNumber int32
+	Name          string
+	EventStart    time.Time
+	File          string
+	// Segments are the files written before File when the recording was
+	// continued in a new file.
+	Segments []string
+	Bytes    int64
+	// Start and Stop are when the capture started and stopped.
+	Start time.Time
+	Stop  time.Time
+	Gaps  []RecordingGap
+	Error string
+	// Warning tells of a problem foreseen before the capture, such as the
+	// recording not fitting on the disk.
+	Warning string
+	// PostProcess are the states of the steps processing the recording
+	// once it has finished.
+	PostProcess []*PostProcessState
+}
+
 type Data struct {
-	RuleConfigMap  map[RuleId]*RuleConfig
-	StreamStateMap map[StreamId]*StreamState
-	StreamInfoMap  map[StreamId]*StreamInfo
+	RuleConfigMap      map[RuleId]*RuleConfig
+	StreamStateMap     map[StreamId]*StreamState
+	StreamInfoMap      map[StreamId]*StreamInfo
+	RecordedEpisodeMap map[EpisodeId]*RecordedEpisode
+	RecordingStateMap  map[RecordingId]*RecordingState
 }
 
 type Stream struct {
@@ -77,6 +193,9 @@ type Event struct {
 	Info           *EventInfo
 	Program        *Program
 	IndexInProgram int
+	// Rule is the manual rule the event is made for, or nil if the event
+	// is from the EPG.
+	Rule *Rule
 }
 
 type Rule struct {
@@ -85,9 +204,18 @@ type Rule struct {
 }
 
 func (event *Event) Id() EventId {
+	if event.Rule != nil {
+		return EventId(fmt.Sprintf("%s@%d", event.Rule.Id, event.Info.Start.Unix()))
+	}
 	return EventId(fmt.Sprintf("%05d@%s", event.IndexInProgram, event.Program.Id()))
 }
 
+// RecordingId identifies the recording of the event, which unlike its id
+// stays the same across scans.
+func (event *Event) RecordingId() RecordingId {
+	return RecordingId(fmt.Sprintf("%05d@%d", event.Program.Info.Number, event.Info.Start.Unix()))
+}
+
 func (event *Event) End() time.Time {
 	return event.Info.Start.Add(event.Info.Duration)
 }
@@ -101,7 +229,11 @@ func (event *Event) Overlaps(otherEvent *Event) bool {
 }
 
 func (program *Program) Id() ProgramId {
-	return ProgramId(fmt.Sprintf("%05d@%s@%s", program.IndexInStream, program.Stream.Info.Time.String(), program.Stream.Id))
+	var infoTime time.Time
+	if program.Stream.Info != nil {
+		infoTime = program.Stream.Info.Time
+	}
+	return ProgramId(fmt.Sprintf("%05d@%s@%s", program.IndexInStream, infoTime.String(), program.Stream.Id))
 }
 
 func (program *Program) Events() (events []*Event) {
@@ -126,6 +258,31 @@ func (stream *Stream) Programs() (programs []*Program) {
 	return
 }
 
+// SharesTransport reports whether the streams are services of the same
+// transport stream, which one tuner can record together.
+func (stream *Stream) SharesTransport(otherStream *Stream) bool {
+	return *stream.Config == *otherStream.Config
+}
+
+// CountTransports returns the number of tuners needed to receive all the
+// events at once.
+func CountTransports(events []*Event) int {
+	count := 0
+	for i, event := range events {
+		shared := false
+		for _, otherEvent := range events[0:i] {
+			if event.Program.Stream.SharesTransport(otherEvent.Program.Stream) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			count++
+		}
+	}
+	return count
+}
+
 func (stream *Stream) Url(assignment int32) (string, error) {
 	config := stream.Config
 	switch config.System {
@@ -138,21 +295,107 @@ func (stream *Stream) Url(assignment int32) (string, error) {
 	}
 }
 
+// Skips reports whether the event is one of the airings skipped by the rule.
+func (config *RuleConfig) Skips(event *Event) bool {
+	recordingId := event.RecordingId()
+	for _, skipped := range config.Skipped {
+		if skipped == recordingId {
+			return true
+		}
+	}
+	return false
+}
+
 func (rule *Rule) MatchEvent(event *Event) bool {
+	if rule.Config.Skips(event) {
+		return false
+	}
+
+	if rule.Config.Manual || event.Rule != nil {
+		return event.Rule != nil && event.Rule.Id == rule.Id
+	}
+
 	if event.Program.Info.Number != rule.Config.ProgramNumber {
 		return false
 	}
 
-	if !rule.Config.Weekly {
-		if event.Info.Start != rule.Config.Start {
+	if rule.Config.Series {
+		if event.Info.Start.Before(rule.Config.Start) || !rule.Config.Until.IsZero() && rule.Config.Until.Before(event.Info.Start) {
 			return false
 		}
-	} else {
-		if event.Info.Start.Location() != rule.Config.Start.Location() || event.Info.Start.Weekday() != rule.Config.Start.Weekday() || event.Info.Start.Hour() != rule.Config.Start.Hour() || event.Info.Start.Minute() != rule.Config.Start.Minute() {
-			return false
+		return SeriesTitle(event.Info.Name) == SeriesTitle(rule.Config.Name)
+	}
+
+	return rule.Config.MatchesStart(event.Info.Start)
+}
+
+// ManualEvents returns the events made for the given manual rule overlapping
+// the given range.
+func (data *Data) ManualEvents(rule *Rule, from time.Time, to time.Time) (events []*Event) {
+	config := rule.Config
+	if config == nil || !config.Manual || config.Duration <= 0 {
+		return nil
+	}
+
+	var program *Program
+	for _, stream := range data.Streams() {
+		if stream.Id != config.StreamId {
+			continue
+		}
+		if stream.Info != nil {
+			for _, streamProgram := range stream.Programs() {
+				if streamProgram.Info.Number == config.ProgramNumber {
+					program = streamProgram
+				}
+			}
+		}
+		if program == nil {
+			program = &Program{
+				Info: &ProgramInfo{
+					Number: config.ProgramNumber,
+					Title:  fmt.Sprint(config.ProgramNumber),
+				},
+				Stream:        stream,
+				IndexInStream: -1,
+			}
 		}
 	}
-	return true
+	if program == nil {
+		return nil
+	}
+
+	for _, start := range config.Occurrences(from, to) {
+		event := &Event{
+			Info: &EventInfo{
+				Start:    start,
+				Duration: config.Duration,
+				Name:     config.Name,
+			},
+			Program: program,
+			Rule:    rule,
+		}
+		if config.Skips(event) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+// AllManualEvents returns the events made for all the manual rules
+// overlapping the given range.
+func (data *Data) AllManualEvents(from time.Time, to time.Time) (events []*Event) {
+	for _, rule := range data.Rules() {
+		events = append(events, data.ManualEvents(rule, from, to)...)
+	}
+	return
+}
+
+// AllowsRebroadcast reports whether another airing of the same episode may
+// be recorded instead of an event matching the rule, which is only the case
+// for series rules as the others ask for the airings at given times.
+func (rule *Rule) AllowsRebroadcast() bool {
+	return rule.Config.Series && !rule.Config.Manual
 }
 
 func (data *Data) InsertRuleConfig(id RuleId, config *RuleConfig) {
@@ -176,6 +419,24 @@ func (data *Data) InsertStreamInfo(id StreamId, info *StreamInfo) {
 	data.StreamInfoMap[id] = info
 }
 
+func (data *Data) InsertRecordedEpisode(id EpisodeId, episode *RecordedEpisode) {
+	if data.RecordedEpisodeMap == nil {
+		data.RecordedEpisodeMap = make(map[EpisodeId]*RecordedEpisode)
+	}
+	data.RecordedEpisodeMap[id] = episode
+}
+
+func (data *Data) InsertRecordingState(id RecordingId, state *RecordingState) {
+	if data.RecordingStateMap == nil {
+		data.RecordingStateMap = make(map[RecordingId]*RecordingState)
+	}
+	data.RecordingStateMap[id] = state
+}
+
+func (data *Data) RecordingState(event *Event) *RecordingState {
+	return data.RecordingStateMap[event.RecordingId()]
+}
+
 func (data *Data) MergeData(newData *Data) {
 	for id, newConfig := range newData.RuleConfigMap {
 		if !newConfig.Deleted {
@@ -192,6 +453,14 @@ func (data *Data) MergeData(newData *Data) {
 	for id, newInfo := range newData.StreamInfoMap {
 		data.InsertStreamInfo(id, newInfo)
 	}
+
+	for id, newEpisode := range newData.RecordedEpisodeMap {
+		data.InsertRecordedEpisode(id, newEpisode)
+	}
+
+	for id, newState := range newData.RecordingStateMap {
+		data.InsertRecordingState(id, newState)
+	}
 }
 
 var streamConfigMap = map[StreamId]*StreamConfig{
@@ -282,18 +551,71 @@ func (data *Data) FindEvent(id EventId) *Event {
 	return nil
 }
 
+func (data *Data) FindProgram(number int32) *Program {
+	for _, program := range data.Programs() {
+		if program.Info.Number == number {
+			return program
+		}
+	}
+	return nil
+}
+
+func (data *Data) EventsMatchingRule(rule *Rule) (events []*Event) {
+	for _, event := range data.Events() {
+		if event.Info == nil {
+			continue
+		}
+		if rule.MatchEvent(event) && !data.IsEpisodeRecorded(rule, event) {
+			events = append(events, event)
+		}
+	}
+	return
+}
+
 func (data *Data) RuleMatchingEvent(event *Event) *Rule {
 	for _, rule := range data.Rules() {
-		if rule.Config == nil {
+		if rule.Config == nil || rule.Config.Disabled {
 			continue
 		}
-		if rule.MatchEvent(event) {
+		if rule.MatchEvent(event) && !data.IsEpisodeRecorded(rule, event) {
 			return rule
 		}
 	}
 	return nil
 }
 
+func (data *Data) CurrentMatchedEvent(now time.Time) *Event {
+	var currentEvent *Event
+	for _, event := range append(data.Events(), data.AllManualEvents(now, now)...) {
+		if event.Info == nil || !event.IsCurrent(now) {
+			continue
+		}
+		if data.RuleMatchingEvent(event) == nil {
+			continue
+		}
+		if currentEvent == nil || currentEvent.End().Before(event.End()) {
+			currentEvent = event
+		}
+	}
+	return currentEvent
+}
+
+func (data *Data) NextMatchedEvent(now time.Time) *Event {
+	var nextEvent *Event
+	for _, event := range append(data.Events(), data.AllManualEvents(now, now.AddDate(0, 0, 8))...) {
+		if event.Info == nil || !now.Before(event.Info.Start) {
+			continue
+		}
+		if data.RuleMatchingEvent(event) == nil {
+			continue
+		}
+		if nextEvent == nil || event.Info.Start.Before(nextEvent.Info.Start) {
+			nextEvent = event
+		}
+	}
+	return nextEvent
+}
+
 type operation struct {
 	t            time.Time
 	addedEvent   *Event
@@ -308,12 +630,27 @@ func (operations operationsByTime) Swap(i, j int) {
 	operations[i], operations[j] = operations[j], operations[i]
 }
 func (operations operationsByTime) Less(i, j int) bool {
+	if operations[i].t.Equal(operations[j].t) {
+		return operations[i].removedEvent != nil && operations[j].removedEvent == nil
+	}
 	return operations[i].t.Before(operations[j].t)
 }
 
+// PriorityToWin returns the priority a rule needs to get tuners ahead of
+// the rules matching the given events.
+func (data *Data) PriorityToWin(events []*Event) int32 {
+	var priority int32
+	for _, event := range events {
+		if rule := data.RuleMatchingEvent(event); rule != nil && rule.Config.Priority >= priority {
+			priority = rule.Config.Priority + 1
+		}
+	}
+	return priority
+}
+
 func (data *Data) OverlappingMatchedEvents(theEvent *Event) []*Event {
 	operations := []*operation{}
-	for _, event := range data.Events() {
+	for _, event := range append(data.Events(), data.AllManualEvents(theEvent.Info.Start, theEvent.End())...) {
 		if event.Info == nil {
 			continue
 		}
@@ -337,17 +674,15 @@ func (data *Data) OverlappingMatchedEvents(theEvent *Event) []*Event {
 
 	sort.Sort(operationsByTime(operations))
 
-	resources := 2
+	tuners := Tuners[theEvent.Program.Stream.Config.System]
 	events := []*Event{}
 	for _, operation := range operations {
 		if operation.addedEvent != nil {
 			events = append(events, operation.addedEvent)
-			resources--
-			if resources <= 0 {
+			if CountTransports(events) >= tuners && CountTransports(append(events, theEvent)) > tuners {
 				return events
 			}
 		} else if operation.removedEvent != nil {
-			resources++
 			for i, event := range events {
 				if event == operation.removedEvent {
 					events[i] = events[len(events)-1]
@@ -3,25 +3,148 @@ package db
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 	"zng.jp/tv"
 )
 
-func FetchData() (*tv.Data, error) {
-	response, err := http.Get("http://zng.jp/tv/tvctl.cgi?mode=json")
+const (
+	maxAttempts    = 5
+	initialBackoff = time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+type Client struct {
+	Url        string
+	HttpClient *http.Client
+}
+
+var DefaultClient = &Client{
+	Url:        "http://zng.jp/tv/tvctl.cgi",
+	HttpClient: http.DefaultClient,
+}
+
+func (client *Client) do(request *http.Request) (*http.Response, error) {
+	httpClient := client.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(request)
+}
+
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (err *StatusError) Error() string {
+	return "Server returned non-OK status: " + strconv.Itoa(err.StatusCode) + " " + err.Body
+}
+
+func (err *StatusError) Temporary() bool {
+	return err.StatusCode >= 500
+}
+
+func newStatusError(response *http.Response) error {
+	body, _ := ioutil.ReadAll(response.Body)
+	return &StatusError{
+		StatusCode: response.StatusCode,
+		Body:       string(body),
+	}
+}
+
+// IsPermanent reports whether err is not worth retrying, such as a 4xx
+// response or a malformed body. The request being cancelled is not permanent,
+// so that its data is kept to be sent later.
+func IsPermanent(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return !isTemporary(err)
+}
+
+func isTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+type backoff struct {
+	duration time.Duration
+}
+
+func (b *backoff) Reset() {
+	b.duration = 0
+}
+
+func (b *backoff) Wait(ctx context.Context) error {
+	if b.duration == 0 {
+		b.duration = initialBackoff
+	} else if b.duration *= 2; b.duration > maxBackoff {
+		b.duration = maxBackoff
+	}
+
+	timer := time.NewTimer(b.duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retry(ctx context.Context, f func() error) error {
+	b := &backoff{}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isTemporary(err) || attempt >= maxAttempts {
+			return err
+		}
+
+		log.Printf("Retrying after a temporary error: %v", err)
+		if err := b.Wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (client *Client) fetchData(ctx context.Context) (*tv.Data, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url+"?mode=json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(request)
 	if err != nil {
 		return nil, err
 	}
 
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(response.Body)
-		return nil, errors.New("Server returned on-OK status: " + strconv.Itoa(response.StatusCode) + " " + string(body))
+		return nil, newStatusError(response)
 	}
 
 	data := &tv.Data{}
@@ -32,18 +155,34 @@ func FetchData() (*tv.Data, error) {
 	return data, nil
 }
 
-func ListenData(notificationQueue chan<- struct{}) error {
-	response, err := http.Get("http://zng.jp/tv/tvctl.cgi?mode=event-stream")
+func (client *Client) FetchData(ctx context.Context) (*tv.Data, error) {
+	var data *tv.Data
+	err := retry(ctx, func() error {
+		var err error
+		data, err = client.fetchData(ctx)
+		return err
+	})
+	return data, err
+}
+
+func (client *Client) listenData(ctx context.Context, notificationQueue chan<- struct{}, connected func()) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url+"?mode=event-stream", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.do(request)
 	if err != nil {
 		return err
 	}
 
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(response.Body)
-		return errors.New("Server returned on-OK status: " + strconv.Itoa(response.StatusCode) + " " + string(body))
+		return newStatusError(response)
 	}
 
+	connected()
+
 	scanner := bufio.NewScanner(response.Body)
 	data := ""
 	for scanner.Scan() {
@@ -51,7 +190,11 @@ func ListenData(notificationQueue chan<- struct{}) error {
 		if line == "" {
 			data = strings.TrimSuffix(data, "\n")
 			if data != "" {
-				notificationQueue <- struct{}{}
+				select {
+				case notificationQueue <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 				data = ""
 			}
 		} else {
@@ -69,34 +212,71 @@ func ListenData(notificationQueue chan<- struct{}) error {
 		}
 	}
 
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
 }
 
-func PostData(cancel <-chan struct{}, data *tv.Data) error {
-	buf := &bytes.Buffer{}
-	if err := json.NewEncoder(buf).Encode(data); err != nil {
-		return err
+// ListenData sends to notificationQueue whenever the data on the server
+// changes. It reconnects with an exponential backoff whenever the stream is
+// lost and only returns once ctx is done.
+func (client *Client) ListenData(ctx context.Context, notificationQueue chan<- struct{}) error {
+	b := &backoff{}
+	for {
+		err := client.listenData(ctx, notificationQueue, b.Reset)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("Listen failed: %v", err)
+		if err := b.Wait(ctx); err != nil {
+			return err
+		}
 	}
+}
 
-	request, err := http.NewRequest(http.MethodPost, "http://zng.jp/tv/tvctl.cgi?mode=json", buf)
+func (client *Client) postData(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, client.Url+"?mode=json", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
-	request.Cancel = cancel
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := client.do(request)
 	if err != nil {
 		return err
 	}
 
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusNoContent {
-		body, _ := ioutil.ReadAll(response.Body)
-		return errors.New("Server returned on-OK status: " + strconv.Itoa(response.StatusCode) + " " + string(body))
+		return newStatusError(response)
 	}
 
 	return nil
 }
+
+func (client *Client) PostData(ctx context.Context, data *tv.Data) error {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+
+	return retry(ctx, func() error {
+		return client.postData(ctx, buf.Bytes())
+	})
+}
+
+func FetchData(ctx context.Context) (*tv.Data, error) {
+	return DefaultClient.FetchData(ctx)
+}
+
+func ListenData(ctx context.Context, notificationQueue chan<- struct{}) error {
+	return DefaultClient.ListenData(ctx, notificationQueue)
+}
+
+func PostData(ctx context.Context, data *tv.Data) error {
+	return DefaultClient.PostData(ctx, data)
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"zng.jp/tv"
+)
+
+func TestIsPermanent(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{}
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{fmt.Errorf("Post: %w", context.DeadlineExceeded), false},
+		{&StatusError{StatusCode: http.StatusBadRequest}, true},
+		{&StatusError{StatusCode: http.StatusNotFound}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+		{io.ErrUnexpectedEOF, false},
+		{syntaxErr, true},
+	} {
+		if got := IsPermanent(test.err); got != test.want {
+			t.Errorf("IsPermanent(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// newTestClient returns a client of a server responding with the given
+// statuses in turn, and the number of requests it received.
+func newTestClient(t *testing.T, statuses ...int) (*Client, *int32) {
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		status := statuses[len(statuses)-1]
+		if index := int(atomic.AddInt32(requests, 1)) - 1; index < len(statuses) {
+			status = statuses[index]
+		}
+		writer.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return &Client{Url: server.URL, HttpClient: server.Client()}, requests
+}
+
+func TestPostDataRetriesTemporaryErrors(t *testing.T) {
+	client, requests := newTestClient(t, http.StatusServiceUnavailable, http.StatusNoContent)
+	if err := client.PostData(context.Background(), &tv.Data{}); err != nil {
+		t.Errorf("PostData failed: %v", err)
+	}
+	if atomic.LoadInt32(requests) != 2 {
+		t.Errorf("Sent %d requests, want 2", atomic.LoadInt32(requests))
+	}
+}
+
+func TestPostDataFailsFastOnPermanentErrors(t *testing.T) {
+	client, requests := newTestClient(t, http.StatusBadRequest)
+	err := client.PostData(context.Background(), &tv.Data{})
+	if !IsPermanent(err) {
+		t.Errorf("PostData returned %v, want a permanent error", err)
+	}
+	if atomic.LoadInt32(requests) != 1 {
+		t.Errorf("Sent %d requests, want 1", atomic.LoadInt32(requests))
+	}
+}
+
+func TestPostDataStopsRetryingWhenCancelled(t *testing.T) {
+	client, requests := newTestClient(t, http.StatusServiceUnavailable)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.PostData(ctx, &tv.Data{})
+	if err == nil || IsPermanent(err) {
+		t.Errorf("PostData returned %v, want a temporary error", err)
+	}
+	if atomic.LoadInt32(requests) > 1 {
+		t.Errorf("Sent %d requests, want at most 1", atomic.LoadInt32(requests))
+	}
+}
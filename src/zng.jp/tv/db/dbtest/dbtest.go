@@ -0,0 +1,65 @@
+// Package dbtest runs tvctl's handler in-process so that clients of the db
+// package can be exercised against a local stand-in for the production host.
+package dbtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"zng.jp/tv/ctl"
+	"zng.jp/tv/db"
+)
+
+type Server struct {
+	*httptest.Server
+
+	// Dir is the temporary directory holding the .data directory.
+	Dir string
+
+	// Client talks to the server.
+	Client *db.Client
+}
+
+// NewServer starts a server backed by an empty .data directory. The caller
+// should call Close when finished to shut it down and remove the directory.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "dbtest")
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir := filepath.Join(dir, ".data")
+	if err := os.Mkdir(dataDir, 0777); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	httpServer := httptest.NewServer(ctl.NewHandler(dataDir, ctl.Assets))
+
+	return &Server{
+		Server: httpServer,
+		Dir:    dir,
+		Client: &db.Client{
+			Url:        httpServer.URL + "/tvctl.cgi",
+			HttpClient: &http.Client{},
+		},
+	}, nil
+}
+
+// Install makes the package-level functions of db talk to the server and
+// returns a function restoring the previous client.
+func (server *Server) Install() func() {
+	client := db.DefaultClient
+	db.DefaultClient = server.Client
+	return func() {
+		db.DefaultClient = client
+	}
+}
+
+func (server *Server) Close() {
+	server.Server.CloseClientConnections()
+	server.Server.Close()
+	os.RemoveAll(server.Dir)
+}
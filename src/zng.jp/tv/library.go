@@ -0,0 +1,218 @@
+package tv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecordingMetadata describes a recording in the JSON sidecar written next to
+// its file.
+type RecordingMetadata struct {
+	Event         *EventInfo
+	ProgramNumber int32
+	ProgramTitle  string
+	StreamId      StreamId
+	RuleId        RuleId
+	// CaptureStart and CaptureStop are when the capture actually started
+	// and stopped.
+	CaptureStart time.Time
+	CaptureStop  time.Time
+	Gaps         []RecordingGap
+	Error        string
+}
+
+// SidecarFile returns the file the metadata of the recording in the given file
+// is written to.
+func SidecarFile(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".json"
+}
+
+func ReadRecordingMetadata(file string) (*RecordingMetadata, error) {
+	in, err := os.Open(SidecarFile(file))
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	metadata := &RecordingMetadata{}
+	if err := json.NewDecoder(in).Decode(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// WriteRecordingMetadata writes the sidecar of the recording in the given file,
+// replacing it at once so that readers never see it half written.
+func WriteRecordingMetadata(file string, metadata *RecordingMetadata) error {
+	sidecarFile := SidecarFile(file)
+	out, err := os.Create(sidecarFile + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(metadata); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(sidecarFile+".tmp", sidecarFile)
+}
+
+// LibraryEntry is a recording found in the output directory.
+type LibraryEntry struct {
+	File     string
+	Size     int64
+	ModTime  time.Time
+	Metadata *RecordingMetadata
+}
+
+func (entry *LibraryEntry) Name() string {
+	if entry.Metadata != nil && entry.Metadata.Event != nil {
+		return entry.Metadata.Event.Name
+	}
+	base := filepath.Base(entry.File)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func (entry *LibraryEntry) SeriesTitle() string {
+	return SeriesTitle(entry.Name())
+}
+
+func (entry *LibraryEntry) ProgramTitle() string {
+	if entry.Metadata == nil {
+		return ""
+	}
+	return entry.Metadata.ProgramTitle
+}
+
+// Start returns when the recorded event started, or when the file was last
+// written to if it is unknown.
+func (entry *LibraryEntry) Start() time.Time {
+	if entry.Metadata == nil {
+		return entry.ModTime
+	}
+	if entry.Metadata.Event != nil {
+		return entry.Metadata.Event.Start
+	}
+	if !entry.Metadata.CaptureStart.IsZero() {
+		return entry.Metadata.CaptureStart
+	}
+	return entry.ModTime
+}
+
+// RecordingId returns the recording the file belongs to, which the segments of
+// a split recording share, or an id made of the file if it is unknown.
+func (entry *LibraryEntry) RecordingId() RecordingId {
+	if entry.Metadata == nil || entry.Metadata.Event == nil {
+		return RecordingId(entry.File)
+	}
+	return RecordingId(fmt.Sprintf("%05d@%d", entry.Metadata.ProgramNumber, entry.Metadata.Event.Start.Unix()))
+}
+
+// Duration returns how long was captured, or zero if it is unknown.
+func (entry *LibraryEntry) Duration() time.Duration {
+	if entry.Metadata == nil || entry.Metadata.CaptureStart.IsZero() || entry.Metadata.CaptureStop.IsZero() {
+		return 0
+	}
+	duration := entry.Metadata.CaptureStop.Sub(entry.Metadata.CaptureStart)
+	for _, gap := range entry.Metadata.Gaps {
+		duration -= gap.Stop.Sub(gap.Start)
+	}
+	return duration
+}
+
+// Matches reports whether the name, the description or the channel of the
+// recording contains the given text, ignoring case.
+func (entry *LibraryEntry) Matches(text string) bool {
+	text = strings.ToLower(text)
+	if strings.Contains(strings.ToLower(entry.Name()), text) || strings.Contains(strings.ToLower(entry.ProgramTitle()), text) {
+		return true
+	}
+	return entry.Metadata != nil && entry.Metadata.Event != nil && strings.Contains(strings.ToLower(entry.Metadata.Event.Description), text)
+}
+
+// metadataFromState returns what the latest recording state of the file tells
+// about it, for recordings without sidecars. Files are compared by name as the
+// directory may be mounted elsewhere.
+func (data *Data) metadataFromState(file string) *RecordingMetadata {
+	var latestState *RecordingState
+	for _, state := range data.RecordingStateMap {
+		if filepath.Base(state.File) != filepath.Base(file) {
+			continue
+		}
+		if latestState == nil || state.EventStart.After(latestState.EventStart) {
+			latestState = state
+		}
+	}
+	if latestState == nil {
+		return nil
+	}
+
+	metadata := &RecordingMetadata{
+		Event: &EventInfo{
+			Start: latestState.EventStart,
+			Name:  latestState.Name,
+		},
+		ProgramNumber: latestState.ProgramNumber,
+		CaptureStart:  latestState.Start,
+		CaptureStop:   latestState.Stop,
+		Gaps:          latestState.Gaps,
+		Error:         latestState.Error,
+	}
+	if program := data.FindProgram(latestState.ProgramNumber); program != nil {
+		metadata.ProgramTitle = program.Info.Title
+		metadata.StreamId = program.Stream.Id
+	}
+	return metadata
+}
+
+type libraryEntriesByStart []*LibraryEntry
+
+func (entries libraryEntriesByStart) Len() int {
+	return len(entries)
+}
+func (entries libraryEntriesByStart) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+func (entries libraryEntriesByStart) Less(i, j int) bool {
+	return entries[i].Start().After(entries[j].Start())
+}
+
+// ScanLibrary returns the recordings in the given directory, latest first,
+// describing them with their sidecars or else with their recording states.
+func (data *Data) ScanLibrary(dir string) ([]*LibraryEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.ts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*LibraryEntry
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		entry := &LibraryEntry{
+			File:    file,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if metadata, err := ReadRecordingMetadata(file); err == nil {
+			entry.Metadata = metadata
+		} else {
+			entry.Metadata = data.metadataFromState(file)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(libraryEntriesByStart(entries))
+	return entries, nil
+}
@@ -0,0 +1,440 @@
+package tv
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tuners is the number of tuners available for each system.
+var Tuners = map[int32]int{
+	ISDB_T: 2,
+	ISDB_S: 2,
+}
+
+type Recording struct {
+	Event *Event
+	Rule  *Rule
+	// Tuner is the index of the tuner assigned to the recording, or -1 if
+	// all tuners are taken. Recordings on the same transport stream may
+	// share a tuner.
+	Tuner int32
+	// Original is the matched event this rebroadcast is recorded instead of.
+	Original *Event
+	// Replacement is the rebroadcast recorded instead of this event.
+	Replacement *Recording
+	// PreemptedAt is when the recording is interrupted for a recording of
+	// higher priority, or zero if it is recorded to the end.
+	PreemptedAt time.Time
+}
+
+type Conflict struct {
+	Start  time.Time
+	End    time.Time
+	System int32
+	Events []*Event
+}
+
+// End returns when the recording stops, which is before the end of the event
+// if it is preempted.
+func (recording *Recording) End() time.Time {
+	if !recording.PreemptedAt.IsZero() {
+		return recording.PreemptedAt
+	}
+	return recording.Event.End()
+}
+
+func (recording *Recording) Overlaps(otherRecording *Recording) bool {
+	return otherRecording.Event.Info.Start.Before(recording.End()) && recording.Event.Info.Start.Before(otherRecording.End())
+}
+
+// ConflictsWith reports whether the recordings cannot share a tuner, which
+// they can if they are on the same transport stream.
+func (recording *Recording) ConflictsWith(otherRecording *Recording) bool {
+	return recording.Overlaps(otherRecording) && !recording.Event.Program.Stream.SharesTransport(otherRecording.Event.Program.Stream)
+}
+
+// Missed reports whether the event is not recorded in full.
+func (recording *Recording) Missed() bool {
+	return recording.Tuner < 0 || !recording.PreemptedAt.IsZero()
+}
+
+// IsRecording reports whether the recording holds its tuner at the given
+// time.
+func (recording *Recording) IsRecording(now time.Time) bool {
+	if recording.Tuner < 0 || !recording.Event.IsCurrent(now) {
+		return false
+	}
+	return recording.PreemptedAt.IsZero() || now.Before(recording.PreemptedAt)
+}
+
+func (recording *Recording) TunerName() string {
+	if recording.Tuner < 0 {
+		return "-"
+	}
+	switch recording.Event.Program.Stream.Config.System {
+	case ISDB_T:
+		return fmt.Sprintf("T%d", recording.Tuner)
+	case ISDB_S:
+		return fmt.Sprintf("S%d", recording.Tuner)
+	default:
+		return fmt.Sprintf("%d", recording.Tuner)
+	}
+}
+
+// Reason explains why a rebroadcast is recorded instead of the original.
+func (recording *Recording) Reason() string {
+	if recording.Original == nil {
+		return recording.Rule.Config.Reason
+	}
+	return fmt.Sprintf("%s on %s at %s conflicts with other recordings", recording.Original.Info.Name, recording.Original.Program.Info.Title, recording.Original.Info.Start.Format("01-02 15:04"))
+}
+
+func (conflict *Conflict) Tuners() int {
+	return Tuners[conflict.System]
+}
+
+func (conflict *Conflict) Contains(event *Event) bool {
+	for _, conflictingEvent := range conflict.Events {
+		if conflictingEvent == event {
+			return true
+		}
+	}
+	return false
+}
+
+type recordingsByStart []*Recording
+
+func (recordings recordingsByStart) Len() int {
+	return len(recordings)
+}
+func (recordings recordingsByStart) Swap(i, j int) {
+	recordings[i], recordings[j] = recordings[j], recordings[i]
+}
+func (recordings recordingsByStart) Less(i, j int) bool {
+	if !recordings[i].Event.Info.Start.Equal(recordings[j].Event.Info.Start) {
+		return recordings[i].Event.Info.Start.Before(recordings[j].Event.Info.Start)
+	}
+	if recordings[i].Rule.Config.Priority != recordings[j].Rule.Config.Priority {
+		return recordings[i].Rule.Config.Priority > recordings[j].Rule.Config.Priority
+	}
+	return recordings[i].Event.Id() < recordings[j].Event.Id()
+}
+
+type recordingsByPriority []*Recording
+
+func (recordings recordingsByPriority) Len() int {
+	return len(recordings)
+}
+func (recordings recordingsByPriority) Swap(i, j int) {
+	recordings[i], recordings[j] = recordings[j], recordings[i]
+}
+func (recordings recordingsByPriority) Less(i, j int) bool {
+	if recordings[i].Rule.Config.Priority != recordings[j].Rule.Config.Priority {
+		return recordings[i].Rule.Config.Priority > recordings[j].Rule.Config.Priority
+	}
+	return recordingsByStart(recordings).Less(i, j)
+}
+
+type conflictsByStart []*Conflict
+
+func (conflicts conflictsByStart) Len() int {
+	return len(conflicts)
+}
+func (conflicts conflictsByStart) Swap(i, j int) {
+	conflicts[i], conflicts[j] = conflicts[j], conflicts[i]
+}
+func (conflicts conflictsByStart) Less(i, j int) bool {
+	return conflicts[i].Start.Before(conflicts[j].Start)
+}
+
+// PlanRecordings returns the matched events overlapping the given range in
+// order of their start, with the tuners they would be assigned, and the time
+// ranges where more matched events overlap than there are tuners.
+//
+// Tuners are reserved for recordings of higher priority ahead of their start,
+// so a recording is not started if it would make one of them miss. A
+// recording in progress keeps its tuner unless the rule of a recording of
+// higher priority allows preempting it.
+func (data *Data) PlanRecordings(from time.Time, to time.Time) ([]*Recording, []*Conflict) {
+	var recordings []*Recording
+	for _, event := range append(data.Events(), data.AllManualEvents(from, to)...) {
+		if event.Info == nil {
+			continue
+		}
+		if !from.Before(event.End()) || !event.Info.Start.Before(to) {
+			continue
+		}
+		rule := data.RuleMatchingEvent(event)
+		if rule == nil {
+			continue
+		}
+		recordings = append(recordings, &Recording{
+			Event: event,
+			Rule:  rule,
+			Tuner: -1,
+		})
+	}
+	sort.Sort(recordingsByStart(recordings))
+	recordings = dropRepeatedEpisodes(recordings)
+
+	for i, recording := range recordings {
+		recording.Tuner = assignTuner(recording, recordings[0:i], recordings[i+1:])
+	}
+
+	conflicts := findConflicts(recordings)
+
+	for _, recording := range recordings {
+		if !recording.Missed() || !recording.Rule.AllowsRebroadcast() {
+			continue
+		}
+		replacement := findRecordedEpisode(recording, recordings)
+		if replacement == nil {
+			replacement = data.findRebroadcast(recording, recordings, from)
+			if replacement != nil {
+				recordings = append(recordings, replacement)
+			}
+		}
+		recording.Replacement = replacement
+	}
+	sort.Sort(recordingsByStart(recordings))
+
+	return recordings, conflicts
+}
+
+// assignTuner returns the tuner for the given recording, or -1 if it would
+// take a tuner needed by a later recording of higher priority. The recordings
+// are decided in order of their start, so a decision never depends on the
+// time the plan is made at.
+func assignTuner(recording *Recording, decidedRecordings []*Recording, undecidedRecordings []*Recording) int32 {
+	system := recording.Event.Program.Stream.Config.System
+	start := recording.Event.Info.Start
+	priority := recording.Rule.Config.Priority
+
+	schedules := make([][]*Recording, Tuners[system])
+	for _, decidedRecording := range decidedRecordings {
+		if decidedRecording.Tuner < 0 || decidedRecording.Event.Program.Stream.Config.System != system {
+			continue
+		}
+		if decidedRecording.End().After(start) {
+			schedules[decidedRecording.Tuner] = append(schedules[decidedRecording.Tuner], decidedRecording)
+		}
+	}
+
+	var reservedRecordings []*Recording
+	for _, undecidedRecording := range undecidedRecordings {
+		if undecidedRecording.Event.Program.Stream.Config.System != system {
+			continue
+		}
+		if undecidedRecording.Rule.Config.Priority > priority {
+			reservedRecordings = append(reservedRecordings, undecidedRecording)
+		}
+	}
+	sort.Sort(recordingsByPriority(reservedRecordings))
+	for _, reservedRecording := range reservedRecordings {
+		if tuner := findFreeTuner(schedules, reservedRecording); tuner >= 0 {
+			schedules[tuner] = append(schedules[tuner], reservedRecording)
+		}
+	}
+
+	if tuner := findFreeTuner(schedules, recording); tuner >= 0 {
+		return int32(tuner)
+	}
+
+	if !recording.Rule.Config.Preempt {
+		return -1
+	}
+	for tuner, schedule := range schedules {
+		victims := conflictingRecordings(schedule, recording)
+		preemptible := true
+		for _, victim := range victims {
+			if victim.Tuner < 0 || !victim.Event.Info.Start.Before(start) || victim.Rule.Config.Priority >= priority {
+				preemptible = false
+				break
+			}
+		}
+		if preemptible {
+			for _, victim := range victims {
+				victim.PreemptedAt = start
+			}
+			return int32(tuner)
+		}
+	}
+	return -1
+}
+
+func conflictingRecordings(schedule []*Recording, recording *Recording) (recordings []*Recording) {
+	for _, scheduledRecording := range schedule {
+		if scheduledRecording.ConflictsWith(recording) {
+			recordings = append(recordings, scheduledRecording)
+		}
+	}
+	return
+}
+
+// findFreeTuner returns a tuner where the recording conflicts with nothing,
+// preferring one already tuned to its transport stream, or -1 if there is
+// none.
+func findFreeTuner(schedules [][]*Recording, recording *Recording) int {
+	freeTuner := -1
+	for tuner, schedule := range schedules {
+		if len(conflictingRecordings(schedule, recording)) != 0 {
+			continue
+		}
+		for _, scheduledRecording := range schedule {
+			if scheduledRecording.Overlaps(recording) {
+				return tuner
+			}
+		}
+		if freeTuner < 0 {
+			freeTuner = tuner
+		}
+	}
+	return freeTuner
+}
+
+var titleMarkerPattern = regexp.MustCompile(`\[[^\]]{1,2}\]|【[^】]{1,2}】|[🈀-🉑]`)
+
+// NormalizeTitle strips the markers such as [字] and 【再】 from an event name
+// so that airings of the same episode can be compared.
+func NormalizeTitle(name string) string {
+	name = titleMarkerPattern.ReplaceAllString(name, "")
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func normalizeDescription(description string) string {
+	return strings.Join(strings.Fields(description), " ")
+}
+
+func (event *Event) IsSameEpisode(otherEvent *Event) bool {
+	return NormalizeTitle(event.Info.Name) == NormalizeTitle(otherEvent.Info.Name) && normalizeDescription(event.Info.Description) == normalizeDescription(otherEvent.Info.Description)
+}
+
+func findRecordedEpisode(recording *Recording, recordings []*Recording) *Recording {
+	for _, otherRecording := range recordings {
+		if otherRecording.Tuner < 0 || otherRecording.Event.Id() == recording.Event.Id() {
+			continue
+		}
+		if otherRecording.Event.IsSameEpisode(recording.Event) {
+			return otherRecording
+		}
+	}
+	return nil
+}
+
+// findRebroadcast returns a recording of another airing of the same episode
+// as the given recording that fits in the tuners left free by recordings and
+// reserved for none of the later recordings of higher priority, as
+// assignTuner would keep them when the rebroadcast is planned again.
+func (data *Data) findRebroadcast(recording *Recording, recordings []*Recording, from time.Time) *Recording {
+	var candidates []*Recording
+	for _, event := range data.Events() {
+		if event.Info == nil || event.Info.Start.Before(from) {
+			continue
+		}
+		if event.Id() == recording.Event.Id() || !event.IsSameEpisode(recording.Event) {
+			continue
+		}
+		candidates = append(candidates, &Recording{
+			Event:    event,
+			Rule:     recording.Rule,
+			Tuner:    -1,
+			Original: recording.Event,
+		})
+	}
+	sort.Sort(recordingsByStart(candidates))
+
+	for _, candidate := range candidates {
+		planned := false
+		system := candidate.Event.Program.Stream.Config.System
+		schedules := make([][]*Recording, Tuners[system])
+		for _, otherRecording := range recordings {
+			if otherRecording.Event.Id() == candidate.Event.Id() {
+				planned = true
+				break
+			}
+			if otherRecording.Tuner < 0 || otherRecording.Event.Program.Stream.Config.System != system {
+				continue
+			}
+			schedules[otherRecording.Tuner] = append(schedules[otherRecording.Tuner], otherRecording)
+		}
+		if planned {
+			continue
+		}
+
+		var reservedRecordings []*Recording
+		for _, otherRecording := range recordings {
+			if otherRecording.Tuner >= 0 || otherRecording.Event.Program.Stream.Config.System != system {
+				continue
+			}
+			if otherRecording.Event.Info.Start.After(candidate.Event.Info.Start) && otherRecording.Rule.Config.Priority > candidate.Rule.Config.Priority {
+				reservedRecordings = append(reservedRecordings, otherRecording)
+			}
+		}
+		sort.Sort(recordingsByPriority(reservedRecordings))
+		for _, reservedRecording := range reservedRecordings {
+			if tuner := findFreeTuner(schedules, reservedRecording); tuner >= 0 {
+				schedules[tuner] = append(schedules[tuner], reservedRecording)
+			}
+		}
+
+		if tuner := findFreeTuner(schedules, candidate); tuner >= 0 {
+			candidate.Tuner = int32(tuner)
+			return candidate
+		}
+	}
+	return nil
+}
+
+func findConflicts(recordings []*Recording) []*Conflict {
+	operationsBySystem := make(map[int32][]*operation)
+	for _, recording := range recordings {
+		event := recording.Event
+		system := event.Program.Stream.Config.System
+		operationsBySystem[system] = append(operationsBySystem[system], &operation{
+			t:          event.Info.Start,
+			addedEvent: event,
+		}, &operation{
+			t:            event.End(),
+			removedEvent: event,
+		})
+	}
+
+	var conflicts []*Conflict
+	for system, operations := range operationsBySystem {
+		sort.Sort(operationsByTime(operations))
+
+		var conflict *Conflict
+		var events []*Event
+		for _, operation := range operations {
+			if operation.addedEvent != nil {
+				events = append(events, operation.addedEvent)
+				if conflict != nil {
+					conflict.Events = append(conflict.Events, operation.addedEvent)
+				} else if CountTransports(events) > Tuners[system] {
+					conflict = &Conflict{
+						Start:  operation.t,
+						System: system,
+						Events: append([]*Event{}, events...),
+					}
+				}
+			} else if operation.removedEvent != nil {
+				for i, event := range events {
+					if event == operation.removedEvent {
+						events = append(events[0:i], events[i+1:]...)
+						break
+					}
+				}
+				if conflict != nil && CountTransports(events) <= Tuners[system] {
+					conflict.End = operation.t
+					conflicts = append(conflicts, conflict)
+					conflict = nil
+				}
+			}
+		}
+	}
+	sort.Sort(conflictsByStart(conflicts))
+	return conflicts
+}
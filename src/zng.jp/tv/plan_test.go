@@ -0,0 +1,232 @@
+package tv
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+
+// insertProgram adds a program airing the given events to the stream.
+func insertProgram(data *Data, streamId StreamId, number int32, events ...*EventInfo) {
+	info := data.StreamInfoMap[streamId]
+	if info == nil {
+		info = &StreamInfo{Time: testStart}
+		data.InsertStreamInfo(streamId, info)
+	}
+	info.Programs = append(info.Programs, &ProgramInfo{Number: number, Title: string(streamId), Events: events})
+}
+
+// airing returns an event starting the given minutes after testStart.
+func airing(name string, minutes int, duration int) *EventInfo {
+	return &EventInfo{
+		Start:    testStart.Add(time.Duration(minutes) * time.Minute),
+		Duration: time.Duration(duration) * time.Minute,
+		Name:     name,
+	}
+}
+
+// insertRule adds a rule recording the event on the program.
+func insertRule(data *Data, number int32, info *EventInfo, priority int32, preempt bool) {
+	data.InsertRuleConfig(RuleId(info.Name), &RuleConfig{
+		ProgramNumber: number,
+		Start:         info.Start,
+		Duration:      info.Duration,
+		Name:          info.Name,
+		Priority:      priority,
+		Preempt:       preempt,
+	})
+}
+
+func findRecording(recordings []*Recording, name string, start time.Time) *Recording {
+	for _, recording := range recordings {
+		if recording.Event.Info.Name == name && recording.Event.Info.Start.Equal(start) {
+			return recording
+		}
+	}
+	return nil
+}
+
+func TestPlanRecordingsReservesForHigherPriority(t *testing.T) {
+	data := &Data{}
+	first := airing("First", 0, 120)
+	second := airing("Second", 0, 120)
+	important := airing("Important", 60, 30)
+	insertProgram(data, "00101", 101, first)
+	insertProgram(data, "00103", 103, second)
+	insertProgram(data, "00141", 141, important)
+	insertRule(data, 101, first, 0, false)
+	insertRule(data, 103, second, 0, false)
+	insertRule(data, 141, important, 5, false)
+
+	recordings, conflicts := data.PlanRecordings(testStart, testStart.Add(3*time.Hour))
+	if len(recordings) != 3 {
+		t.Fatalf("Planned %d recordings, want 3", len(recordings))
+	}
+	if recording := findRecording(recordings, "Important", important.Start); recording.Tuner < 0 {
+		t.Errorf("The recording of higher priority has no tuner")
+	}
+	missed := 0
+	for _, recording := range recordings {
+		if recording.Tuner < 0 {
+			missed++
+		}
+	}
+	if missed != 1 {
+		t.Errorf("%d recordings have no tuner, want 1", missed)
+	}
+	if len(conflicts) != 1 || len(conflicts[0].Events) != 3 {
+		t.Errorf("Got %d conflicts, want 1 of 3 events", len(conflicts))
+	}
+}
+
+func TestPlanRecordingsSharesTransport(t *testing.T) {
+	data := &Data{}
+	first := airing("First", 0, 60)
+	second := airing("Second", 0, 60)
+	third := airing("Third", 0, 60)
+	insertProgram(data, "00001", 1024, first)
+	insertProgram(data, "00001", 1025, second)
+	insertProgram(data, "00002", 1032, third)
+	insertRule(data, 1024, first, 0, false)
+	insertRule(data, 1025, second, 0, false)
+	insertRule(data, 1032, third, 0, false)
+
+	recordings, conflicts := data.PlanRecordings(testStart, testStart.Add(time.Hour))
+	if len(conflicts) != 0 {
+		t.Errorf("Got %d conflicts, want none", len(conflicts))
+	}
+	firstRecording := findRecording(recordings, "First", first.Start)
+	secondRecording := findRecording(recordings, "Second", second.Start)
+	thirdRecording := findRecording(recordings, "Third", third.Start)
+	if firstRecording.Tuner < 0 || firstRecording.Tuner != secondRecording.Tuner {
+		t.Errorf("The services of a transport are on tuners %d and %d, want one", firstRecording.Tuner, secondRecording.Tuner)
+	}
+	if thirdRecording.Tuner < 0 || thirdRecording.Tuner == firstRecording.Tuner {
+		t.Errorf("Another transport is on tuner %d", thirdRecording.Tuner)
+	}
+}
+
+func TestPlanRecordingsRecordsRebroadcast(t *testing.T) {
+	data := &Data{}
+	drama := airing("Drama #3", 0, 60)
+	drama.Description = "The third episode."
+	rebroadcast := airing("Drama #3 [再]", 180, 60)
+	rebroadcast.Description = "The third episode."
+	first := airing("First", 0, 60)
+	second := airing("Second", 0, 60)
+	insertProgram(data, "00101", 101, drama)
+	insertProgram(data, "00103", 103, first)
+	insertProgram(data, "00141", 141, second)
+	insertProgram(data, "00151", 151, rebroadcast)
+	data.InsertRuleConfig("drama", &RuleConfig{ProgramNumber: 101, Start: testStart, Name: "Drama", Series: true})
+	insertRule(data, 103, first, 5, false)
+	insertRule(data, 141, second, 5, false)
+
+	recordings, _ := data.PlanRecordings(testStart, testStart.Add(2*time.Hour))
+	original := findRecording(recordings, "Drama #3", drama.Start)
+	if original == nil || original.Tuner >= 0 {
+		t.Fatalf("The episode is planned as %+v, want without a tuner", original)
+	}
+	replacement := original.Replacement
+	if replacement == nil || replacement.Event.Info.Name != rebroadcast.Name || replacement.Tuner < 0 {
+		t.Fatalf("The replacement is %+v, want the rebroadcast with a tuner", replacement)
+	}
+	if replacement.Original != original.Event || replacement.Rule.Id != "drama" {
+		t.Errorf("The rebroadcast is recorded for %v instead of the original airing", replacement.Rule.Id)
+	}
+}
+
+func TestPlanRecordingsRecordsNoRebroadcastForWeeklyRules(t *testing.T) {
+	data := &Data{}
+	drama := airing("Drama #3", 0, 60)
+	rebroadcast := airing("Drama #3", 180, 60)
+	first := airing("First", 0, 60)
+	second := airing("Second", 0, 60)
+	insertProgram(data, "00101", 101, drama)
+	insertProgram(data, "00103", 103, first)
+	insertProgram(data, "00141", 141, second)
+	insertProgram(data, "00151", 151, rebroadcast)
+	data.InsertRuleConfig("drama", &RuleConfig{ProgramNumber: 101, Start: testStart, Duration: time.Hour, Name: "Drama", Weekly: true})
+	insertRule(data, 103, first, 5, false)
+	insertRule(data, 141, second, 5, false)
+
+	recordings, _ := data.PlanRecordings(testStart, testStart.Add(2*time.Hour))
+	if original := findRecording(recordings, "Drama #3", drama.Start); original == nil || original.Replacement != nil {
+		t.Errorf("The airing of a weekly rule is planned as %+v, want it without a replacement", original)
+	}
+}
+
+func TestAssignTunerPreempts(t *testing.T) {
+	data := &Data{}
+	victim := airing("Victim", 0, 120)
+	other := airing("Other", 0, 120)
+	important := airing("Important", 60, 30)
+	insertProgram(data, "00101", 101, victim)
+	insertProgram(data, "00103", 103, other)
+	insertProgram(data, "00141", 141, important)
+	insertRule(data, 101, victim, 0, false)
+	insertRule(data, 103, other, 10, false)
+	insertRule(data, 141, important, 5, true)
+
+	newRecording := func(info *EventInfo, tuner int32) *Recording {
+		for _, event := range data.Events() {
+			if event.Info == info {
+				return &Recording{Event: event, Rule: data.RuleMatchingEvent(event), Tuner: tuner}
+			}
+		}
+		t.Fatalf("No event %s", info.Name)
+		return nil
+	}
+	victimRecording := newRecording(victim, 0)
+	otherRecording := newRecording(other, 1)
+	importantRecording := newRecording(important, -1)
+
+	// The recordings started before the important one was known.
+	tuner := assignTuner(importantRecording, []*Recording{victimRecording, otherRecording}, nil)
+	if tuner != 0 {
+		t.Errorf("Assigned tuner %d, want 0 of the recording of lower priority", tuner)
+	}
+	if !victimRecording.PreemptedAt.Equal(important.Start) {
+		t.Errorf("The victim is preempted at %v, want %v", victimRecording.PreemptedAt, important.Start)
+	}
+	if !otherRecording.PreemptedAt.IsZero() {
+		t.Errorf("The recording of higher priority is preempted")
+	}
+
+	// Without Preempt, the important recording waits.
+	victimRecording.PreemptedAt = time.Time{}
+	importantRecording.Rule.Config.Preempt = false
+	if tuner := assignTuner(importantRecording, []*Recording{victimRecording, otherRecording}, nil); tuner != -1 {
+		t.Errorf("Assigned tuner %d without Preempt, want -1", tuner)
+	}
+}
+
+func TestAssignTunerKeepsReservation(t *testing.T) {
+	data := &Data{}
+	low := airing("Low", 0, 120)
+	high := airing("High", 30, 60)
+	higher := airing("Higher", 60, 30)
+	insertProgram(data, "00101", 101, low)
+	insertProgram(data, "00103", 103, high)
+	insertProgram(data, "00141", 141, higher)
+	insertRule(data, 101, low, 0, false)
+	insertRule(data, 103, high, 5, false)
+	insertRule(data, 141, higher, 10, false)
+
+	var recordings []*Recording
+	for _, info := range []*EventInfo{low, high, higher} {
+		for _, event := range data.Events() {
+			if event.Info == info {
+				recordings = append(recordings, &Recording{Event: event, Rule: data.RuleMatchingEvent(event), Tuner: -1})
+			}
+		}
+	}
+
+	if tuner := assignTuner(recordings[0], nil, recordings[1:]); tuner != -1 {
+		t.Errorf("Assigned tuner %d to a recording overlapping two of higher priority, want -1", tuner)
+	}
+	if tuner := assignTuner(recordings[1], recordings[0:1], recordings[2:]); tuner < 0 {
+		t.Errorf("Assigned no tuner to a recording with one free")
+	}
+}
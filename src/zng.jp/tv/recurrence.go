@@ -0,0 +1,202 @@
+package tv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var allWeekdays = []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+
+// IsRecurring reports whether the rule matches more than one airing.
+func (config *RuleConfig) IsRecurring() bool {
+	return config.Weekly || config.Daily || len(config.Weekdays) != 0
+}
+
+// RecurringWeekdays returns the days a recurring rule matches on.
+func (config *RuleConfig) RecurringWeekdays() []time.Weekday {
+	if len(config.Weekdays) != 0 {
+		return config.Weekdays
+	}
+	if config.Daily {
+		return allWeekdays
+	}
+	if config.Weekly {
+		return []time.Weekday{config.Start.Weekday()}
+	}
+	return nil
+}
+
+func (config *RuleConfig) HasWeekday(weekday time.Weekday) bool {
+	for _, recurringWeekday := range config.RecurringWeekdays() {
+		if recurringWeekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func date(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(from time.Time, to time.Time) int {
+	return int(date(to).Sub(date(from)) / (24 * time.Hour))
+}
+
+// occurrenceOn returns when the rule would start on the day of the given
+// time in the time zone of Start.
+func (config *RuleConfig) occurrenceOn(t time.Time) time.Time {
+	t = t.In(config.Start.Location())
+	return time.Date(t.Year(), t.Month(), t.Day(), config.Start.Hour(), config.Start.Minute(), config.Start.Second(), 0, config.Start.Location())
+}
+
+// occursAt reports whether the given occurrence, returned by occurrenceOn,
+// is one of the rule, ignoring Count.
+func (config *RuleConfig) occursAt(occurrence time.Time) bool {
+	if occurrence.Before(config.Start) {
+		return false
+	}
+	if !config.Until.IsZero() && config.Until.Before(occurrence) {
+		return false
+	}
+	if !config.HasWeekday(occurrence.Weekday()) {
+		return false
+	}
+	if config.IntervalWeeks > 1 {
+		// Weeks are counted from the Sunday before Start.
+		week := (daysBetween(config.Start, occurrence) + int(config.Start.Weekday())) / 7
+		if week%int(config.IntervalWeeks) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// occurrencesInDays returns the number of days the rule matches on among the
+// given number of days from the Sunday before Start, ignoring Start, Until
+// and Count.
+func (config *RuleConfig) occurrencesInDays(days int) int {
+	interval := int(config.IntervalWeeks)
+	if interval < 1 {
+		interval = 1
+	}
+	weeks := days / 7
+	perWeek := 0
+	partialWeek := 0
+	for _, weekday := range allWeekdays {
+		if config.HasWeekday(weekday) {
+			perWeek++
+			if int(weekday) < days%7 {
+				partialWeek++
+			}
+		}
+	}
+	count := (weeks + interval - 1) / interval * perWeek
+	if weeks%interval == 0 {
+		count += partialWeek
+	}
+	return count
+}
+
+// withinCount reports whether fewer than Count occurrences precede the given
+// one, counting the days the rule matches on since Start.
+func (config *RuleConfig) withinCount(occurrence time.Time) bool {
+	if config.Count <= 0 {
+		return true
+	}
+	offset := int(config.Start.Weekday())
+	count := config.occurrencesInDays(offset+daysBetween(config.Start, occurrence)) - config.occurrencesInDays(offset)
+	return count < int(config.Count)
+}
+
+func absDuration(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return -duration
+	}
+	return duration
+}
+
+// MatchesStart reports whether an airing starting at the given time is one
+// of the rule, allowing it to be off by Tolerance.
+func (config *RuleConfig) MatchesStart(start time.Time) bool {
+	if !config.IsRecurring() {
+		return absDuration(start.Sub(config.Start)) <= config.Tolerance
+	}
+	for _, days := range []int{-1, 0, 1} {
+		occurrence := config.occurrenceOn(start.AddDate(0, 0, days))
+		if absDuration(start.Sub(occurrence)) > config.Tolerance {
+			continue
+		}
+		if config.occursAt(occurrence) && config.withinCount(occurrence) {
+			return true
+		}
+	}
+	return false
+}
+
+// Occurrences returns the starts of the rule overlapping the given range,
+// taking Duration as the length of each.
+func (config *RuleConfig) Occurrences(from time.Time, to time.Time) (occurrences []time.Time) {
+	if !config.IsRecurring() {
+		if from.Before(config.Start.Add(config.Duration)) && config.Start.Before(to) {
+			occurrences = append(occurrences, config.Start)
+		}
+		return
+	}
+
+	t := config.occurrenceOn(config.Start)
+	if fromDay := config.occurrenceOn(from.Add(-config.Duration)).AddDate(0, 0, -1); t.Before(fromDay) {
+		t = fromDay
+	}
+	for ; t.Before(to); t = config.occurrenceOn(t.AddDate(0, 0, 1)) {
+		if !config.Until.IsZero() && config.Until.Before(t) {
+			break
+		}
+		if !from.Before(t.Add(config.Duration)) || !config.occursAt(t) {
+			continue
+		}
+		if !config.withinCount(t) {
+			break
+		}
+		occurrences = append(occurrences, t)
+	}
+	return
+}
+
+// Recurrence describes when a recurring rule matches, or returns an empty
+// string for a rule matching one airing.
+func (config *RuleConfig) Recurrence() string {
+	if !config.IsRecurring() {
+		return ""
+	}
+
+	weekdays := config.RecurringWeekdays()
+	var days string
+	switch {
+	case len(weekdays) == 7 && config.IntervalWeeks <= 1:
+		days = "Every day"
+	case len(weekdays) == 7:
+		days = fmt.Sprintf("Every day of every %d weeks", config.IntervalWeeks)
+	case len(weekdays) == 5 && !config.HasWeekday(time.Saturday) && !config.HasWeekday(time.Sunday) && config.IntervalWeeks <= 1:
+		days = "Weekdays"
+	default:
+		var names []string
+		for _, weekday := range allWeekdays {
+			if config.HasWeekday(weekday) {
+				names = append(names, weekday.String()[0:3])
+			}
+		}
+		days = "Every " + strings.Join(names, ", ")
+		if config.IntervalWeeks > 1 {
+			days = fmt.Sprintf("Every %d weeks on %s", config.IntervalWeeks, strings.Join(names, ", "))
+		}
+	}
+	if !config.Until.IsZero() {
+		days += " until " + config.Until.Format("2006-01-02")
+	}
+	if config.Count > 0 {
+		days += fmt.Sprintf(" (%d times)", config.Count)
+	}
+	return days
+}
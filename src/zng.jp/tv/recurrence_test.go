@@ -0,0 +1,66 @@
+package tv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchesStart(t *testing.T) {
+	// testStart is a Monday.
+	weekly := &RuleConfig{Start: testStart, Weekly: true, Tolerance: 5 * time.Minute}
+	late := &RuleConfig{Start: testStart.Add(178 * time.Minute), Weekly: true, Tolerance: 5 * time.Minute}
+	biweekly := &RuleConfig{Start: testStart, Weekdays: []time.Weekday{time.Monday, time.Wednesday}, IntervalWeeks: 2}
+	counted := &RuleConfig{Start: testStart, Daily: true, Count: 3}
+	until := &RuleConfig{Start: testStart, Daily: true, Until: testStart.AddDate(0, 0, 2)}
+	for _, test := range []struct {
+		name   string
+		config *RuleConfig
+		start  time.Time
+		want   bool
+	}{
+		{"weekly", weekly, testStart.AddDate(0, 0, 7), true},
+		{"weekly within tolerance", weekly, testStart.AddDate(0, 0, 7).Add(3 * time.Minute), true},
+		{"weekly beyond tolerance", weekly, testStart.AddDate(0, 0, 7).Add(10 * time.Minute), false},
+		{"weekly on another day", weekly, testStart.AddDate(0, 0, 1), false},
+		{"weekly before start", weekly, testStart.AddDate(0, 0, -7), false},
+		{"tolerance past midnight", late, late.Start.AddDate(0, 0, 7).Add(4 * time.Minute), true},
+		{"weekdays", biweekly, testStart.AddDate(0, 0, 2), true},
+		{"weekdays in a skipped week", biweekly, testStart.AddDate(0, 0, 7), false},
+		{"weekdays after a skipped week", biweekly, testStart.AddDate(0, 0, 14), true},
+		{"last of count", counted, testStart.AddDate(0, 0, 2), true},
+		{"beyond count", counted, testStart.AddDate(0, 0, 3), false},
+		{"until", until, testStart.AddDate(0, 0, 2), true},
+		{"after until", until, testStart.AddDate(0, 0, 3), false},
+	} {
+		if got := test.config.MatchesStart(test.start); got != test.want {
+			t.Errorf("%s: MatchesStart(%v) = %v, want %v", test.name, test.start, got, test.want)
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	counted := &RuleConfig{Start: testStart, Duration: time.Hour, Daily: true, Count: 3}
+	occurrences := counted.Occurrences(testStart.AddDate(0, 0, -1), testStart.AddDate(0, 0, 7))
+	if len(occurrences) != 3 || !occurrences[2].Equal(testStart.AddDate(0, 0, 2)) {
+		t.Errorf("Occurrences = %v, want the first 3 days", occurrences)
+	}
+
+	biweekly := &RuleConfig{Start: testStart, Duration: time.Hour, Weekdays: []time.Weekday{time.Monday, time.Wednesday}, IntervalWeeks: 2}
+	occurrences = biweekly.Occurrences(testStart.AddDate(0, 0, 7), testStart.AddDate(0, 0, 21))
+	want := []time.Time{testStart.AddDate(0, 0, 14), testStart.AddDate(0, 0, 16)}
+	if len(occurrences) != len(want) || !occurrences[0].Equal(want[0]) || !occurrences[1].Equal(want[1]) {
+		t.Errorf("Occurrences = %v, want %v", occurrences, want)
+	}
+
+	// An airing in progress overlaps the range.
+	weekly := &RuleConfig{Start: testStart, Duration: time.Hour, Weekly: true}
+	occurrences = weekly.Occurrences(testStart.AddDate(0, 0, 7).Add(30*time.Minute), testStart.AddDate(0, 0, 8))
+	if len(occurrences) != 1 || !occurrences[0].Equal(testStart.AddDate(0, 0, 7)) {
+		t.Errorf("Occurrences = %v, want the airing in progress", occurrences)
+	}
+
+	once := &RuleConfig{Start: testStart, Duration: time.Hour}
+	if occurrences := once.Occurrences(testStart.Add(time.Hour), testStart.AddDate(0, 0, 1)); len(occurrences) != 0 {
+		t.Errorf("Occurrences = %v after the airing ended, want none", occurrences)
+	}
+}
@@ -0,0 +1,64 @@
+package tv
+
+import (
+	"fmt"
+	"time"
+)
+
+// RebroadcastRuleId returns the id of the rule made for recording the event as
+// a rebroadcast in place of an airing matched by the rule with the given id.
+func RebroadcastRuleId(ruleId RuleId, event *Event) RuleId {
+	return RuleId(fmt.Sprintf("%s@%05d@%d", ruleId, event.Program.Info.Number, event.Info.Start.Unix()))
+}
+
+// recordingRule returns the id and the config of the rule the recording was
+// made for, which is the original rule for a rebroadcast if it still exists,
+// or nil if it is unknown or deleted.
+func (data *Data) recordingRule(entry *LibraryEntry) (RuleId, *RuleConfig) {
+	if entry.Metadata == nil || entry.Metadata.RuleId == "" {
+		return "", nil
+	}
+	id := entry.Metadata.RuleId
+	config := data.RuleConfigMap[id]
+	if config != nil && config.OriginalRuleId != "" {
+		if originalConfig, ok := data.RuleConfigMap[config.OriginalRuleId]; ok {
+			return config.OriginalRuleId, originalConfig
+		}
+	}
+	return id, config
+}
+
+// ExpiredRecordings returns the recordings that the retention of their rules
+// no longer keeps, given the entries latest first as ScanLibrary returns them.
+// The segments of a split recording count as one episode.
+func (data *Data) ExpiredRecordings(entries []*LibraryEntry, now time.Time) (expired []*LibraryEntry) {
+	episodes := make(map[RuleId]map[RecordingId]bool)
+	for _, entry := range entries {
+		ruleId, config := data.recordingRule(entry)
+		if config == nil || config.KeepForever {
+			continue
+		}
+		if episodes[ruleId] == nil {
+			episodes[ruleId] = make(map[RecordingId]bool)
+		}
+		episodes[ruleId][entry.RecordingId()] = true
+		if config.KeepEpisodes > 0 && int32(len(episodes[ruleId])) > config.KeepEpisodes {
+			expired = append(expired, entry)
+		} else if config.KeepDays > 0 && entry.Start().AddDate(0, 0, int(config.KeepDays)).Before(now) {
+			expired = append(expired, entry)
+		}
+	}
+	return
+}
+
+// DeletableRecordings returns the recordings that may be deleted to free disk
+// space, oldest first, given the entries latest first.
+func (data *Data) DeletableRecordings(entries []*LibraryEntry) (deletable []*LibraryEntry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, config := data.recordingRule(entries[i]); config != nil && config.KeepForever {
+			continue
+		}
+		deletable = append(deletable, entries[i])
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package tv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredRecordingsOfRebroadcasts(t *testing.T) {
+	now := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &Data{}
+	data.InsertRuleConfig("drama", &RuleConfig{Series: true, Name: "Drama", KeepEpisodes: 1})
+	data.InsertRuleConfig("film", &RuleConfig{Series: true, Name: "Film", KeepForever: true})
+	program := &Program{Info: &ProgramInfo{Number: 101}}
+
+	newEntry := func(ruleId RuleId, daysAgo int, rebroadcast bool) *LibraryEntry {
+		start := now.AddDate(0, 0, -daysAgo)
+		if rebroadcast {
+			originalRuleId := ruleId
+			ruleId = RebroadcastRuleId(ruleId, &Event{Info: &EventInfo{Start: start}, Program: program})
+			data.InsertRuleConfig(ruleId, &RuleConfig{Name: "Rebroadcast", OriginalRuleId: originalRuleId})
+		}
+		return &LibraryEntry{
+			File:     string(ruleId),
+			Metadata: &RecordingMetadata{Event: &EventInfo{Start: start}, RuleId: ruleId},
+		}
+	}
+	latestDrama := newEntry("drama", 1, false)
+	rebroadcastDrama := newEntry("drama", 2, true)
+	rebroadcastFilm := newEntry("film", 3, true)
+	entries := []*LibraryEntry{latestDrama, rebroadcastDrama, rebroadcastFilm}
+
+	expired := data.ExpiredRecordings(entries, now)
+	if len(expired) != 1 || expired[0] != rebroadcastDrama {
+		t.Errorf("Got %d expired recordings, want the rebroadcast of Drama", len(expired))
+	}
+
+	for _, entry := range data.DeletableRecordings(entries) {
+		if entry == rebroadcastFilm {
+			t.Errorf("The rebroadcast of a rule kept forever is deletable")
+		}
+	}
+}
+
+func TestExpiredRecordingsOfRulesFromTheGrid(t *testing.T) {
+	now := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &Data{}
+	// Rules made from the grid take the id of the event.
+	ruleId := RuleId("00101@00123@1792400400@00101")
+	data.InsertRuleConfig(ruleId, &RuleConfig{Name: "News", KeepDays: 7})
+	keptId := RuleId("00101@00124@1792400400@00101")
+	data.InsertRuleConfig(keptId, &RuleConfig{Name: "Film", KeepForever: true})
+	rebroadcastId := RebroadcastRuleId(keptId, &Event{Info: &EventInfo{Start: now}, Program: &Program{Info: &ProgramInfo{Number: 101}}})
+	data.InsertRuleConfig(rebroadcastId, &RuleConfig{Name: "Film", OriginalRuleId: keptId})
+
+	old := &LibraryEntry{File: "News.ts", Metadata: &RecordingMetadata{Event: &EventInfo{Start: now.AddDate(0, 0, -8)}, RuleId: ruleId}}
+	film := &LibraryEntry{File: "Film.ts", Metadata: &RecordingMetadata{Event: &EventInfo{Start: now.AddDate(0, 0, -9)}, RuleId: rebroadcastId}}
+	entries := []*LibraryEntry{old, film}
+
+	if expired := data.ExpiredRecordings(entries, now); len(expired) != 1 || expired[0] != old {
+		t.Errorf("Got %d expired recordings, want the one older than KeepDays", len(expired))
+	}
+	if deletable := data.DeletableRecordings(entries); len(deletable) != 1 || deletable[0] != old {
+		t.Errorf("Got %d deletable recordings, want all but the rebroadcast kept forever", len(deletable))
+	}
+}
+
+func TestExpiredRecordingsCountsSegmentsOnce(t *testing.T) {
+	now := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	data := &Data{}
+	data.InsertRuleConfig("drama", &RuleConfig{Series: true, Name: "Drama", KeepEpisodes: 2})
+
+	newEntry := func(file string, daysAgo int) *LibraryEntry {
+		return &LibraryEntry{
+			File:     file,
+			Metadata: &RecordingMetadata{Event: &EventInfo{Start: now.AddDate(0, 0, -daysAgo)}, ProgramNumber: 101, RuleId: "drama"},
+		}
+	}
+	latest := newEntry("Drama #3.ts", 1)
+	split := newEntry("Drama #2.ts", 8)
+	continued := newEntry("Drama #2 (2).ts", 8)
+	oldest := newEntry("Drama #1.ts", 15)
+
+	expired := data.ExpiredRecordings([]*LibraryEntry{latest, split, continued, oldest}, now)
+	if len(expired) != 1 || expired[0] != oldest {
+		t.Errorf("Got %d expired recordings, want the oldest of 3 episodes", len(expired))
+	}
+}
@@ -0,0 +1,130 @@
+package tv
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var episodeNumberPattern = regexp.MustCompile(`[#＃]\s*([0-9]+)|第\s*([0-9]+)\s*[話回]|[(（]\s*([0-9]+)\s*[)）]`)
+var subtitlePattern = regexp.MustCompile(`「[^」]*」`)
+
+func narrowDigits(str string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '０' && r <= '９' {
+			return r - '０' + '0'
+		}
+		return r
+	}, str)
+}
+
+// SeriesTitle strips the markers, the episode number and the subtitle from an
+// event name so that the episodes of a series can be matched.
+func SeriesTitle(name string) string {
+	name = narrowDigits(NormalizeTitle(name))
+	name = episodeNumberPattern.ReplaceAllString(name, "")
+	name = subtitlePattern.ReplaceAllString(name, "")
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// EpisodeNumber returns the episode number in the name or the description of
+// the event, or 0 if there is none.
+func EpisodeNumber(event *Event) int {
+	for _, str := range []string{event.Info.Name, event.Info.Description} {
+		matches := episodeNumberPattern.FindStringSubmatch(narrowDigits(str))
+		if matches == nil {
+			continue
+		}
+		for _, match := range matches[1:] {
+			if number, err := strconv.Atoi(match); err == nil {
+				return number
+			}
+		}
+	}
+	return 0
+}
+
+// EpisodeKey identifies the episode of the event within its series by its
+// number, or by its subtitle and description if it has none. It returns an
+// empty string if the event has neither a number nor a subtitle, as the
+// description alone is often the same for every episode.
+func EpisodeKey(event *Event) string {
+	if number := EpisodeNumber(event); number != 0 {
+		return fmt.Sprintf("#%d", number)
+	}
+	subtitle := subtitlePattern.FindString(NormalizeTitle(event.Info.Name))
+	if subtitle == "" {
+		return ""
+	}
+	description := normalizeDescription(event.Info.Description)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(subtitle+"\n"+description)))[0:16]
+}
+
+func episodeId(rule *Rule, key string) EpisodeId {
+	return EpisodeId(fmt.Sprintf("%s@%s", rule.Id, key))
+}
+
+// NewRecordedEpisode returns the episode to remember for the event recorded
+// for a series rule, or nil if the rule is not a series rule or the episode
+// cannot be told apart.
+func NewRecordedEpisode(rule *Rule, event *Event) (EpisodeId, *RecordedEpisode) {
+	if !rule.Config.Series {
+		return "", nil
+	}
+	key := EpisodeKey(event)
+	if key == "" {
+		return "", nil
+	}
+	return episodeId(rule, key), &RecordedEpisode{
+		RuleId: rule.Id,
+		Key:    key,
+		Start:  event.Info.Start,
+		Name:   event.Info.Name,
+	}
+}
+
+// IsEpisodeRecorded reports whether the episode of the event was recorded
+// for the series rule at another airing.
+func (data *Data) IsEpisodeRecorded(rule *Rule, event *Event) bool {
+	if !rule.Config.Series {
+		return false
+	}
+	key := EpisodeKey(event)
+	if key == "" {
+		return false
+	}
+	episode := data.RecordedEpisodeMap[episodeId(rule, key)]
+	return episode != nil && !episode.Start.Equal(event.Info.Start)
+}
+
+// RecordedEpisodes returns the episodes recorded for the rule.
+func (data *Data) RecordedEpisodes(rule *Rule) (episodes []*RecordedEpisode) {
+	for _, episode := range data.RecordedEpisodeMap {
+		if episode.RuleId == rule.Id {
+			episodes = append(episodes, episode)
+		}
+	}
+	return
+}
+
+// dropRepeatedEpisodes keeps only the first airing of each episode matched by
+// a series rule.
+func dropRepeatedEpisodes(recordings []*Recording) []*Recording {
+	var keptRecordings []*Recording
+	seen := make(map[EpisodeId]bool)
+	for _, recording := range recordings {
+		if recording.Rule.Config.Series {
+			if key := EpisodeKey(recording.Event); key != "" {
+				id := episodeId(recording.Rule, key)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+			}
+		}
+		keptRecordings = append(keptRecordings, recording)
+	}
+	return keptRecordings
+}
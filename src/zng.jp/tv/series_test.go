@@ -0,0 +1,32 @@
+package tv
+
+import (
+	"testing"
+)
+
+func TestEpisodeKey(t *testing.T) {
+	newEvent := func(name string, description string) *Event {
+		return &Event{Info: &EventInfo{Name: name, Description: description}}
+	}
+	boilerplate := "The adventures of a detective in Tokyo."
+
+	if key := EpisodeKey(newEvent("Detective #3", boilerplate)); key != "#3" {
+		t.Errorf("EpisodeKey = %q, want #3", key)
+	}
+	if key := EpisodeKey(newEvent("Detective", "第３話 "+boilerplate)); key != "#3" {
+		t.Errorf("EpisodeKey = %q of a number in the description, want #3", key)
+	}
+
+	first := EpisodeKey(newEvent("Detective「The Bridge」", boilerplate))
+	second := EpisodeKey(newEvent("Detective「The Tunnel」", boilerplate))
+	if first == "" || first == second {
+		t.Errorf("EpisodeKey = %q and %q of different subtitles, want different keys", first, second)
+	}
+	if again := EpisodeKey(newEvent("Detective「The Bridge」", boilerplate)); again != first {
+		t.Errorf("EpisodeKey = %q of a rebroadcast, want %q", again, first)
+	}
+
+	if key := EpisodeKey(newEvent("Detective", boilerplate)); key != "" {
+		t.Errorf("EpisodeKey = %q without a number or subtitle, want none", key)
+	}
+}